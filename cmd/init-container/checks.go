@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+)
+
+// checkTimeout bounds a single readiness check.
+const checkTimeout = 5 * time.Second
+
+// runCheck performs the check against the given host, which is the value of
+// the required variable.
+func runCheck(c requirement.Check, host string) error {
+	switch c.Kind {
+	case requirement.CheckDNS:
+		if _, err := net.LookupHost(host); err != nil {
+			return err
+		}
+	case requirement.CheckTCP:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, c.Port), checkTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case requirement.CheckHTTP, requirement.CheckHTTPS:
+		address := host
+		if c.Port != "" {
+			address = net.JoinHostPort(host, c.Port)
+		}
+		client := http.Client{Timeout: checkTimeout}
+		resp, err := client.Get(fmt.Sprintf("%s://%s%s", c.Kind, address, c.Path))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -2,24 +2,268 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+)
+
+// Exit codes of the init container, so the reason it gave up is visible in the
+// pod status without reading its logs.
+const (
+	exitInvalidConfig = 1
+	exitMissingVar    = 2
+	exitCheckFailed   = 3
 )
 
+// settings holds the configuration of the init container. All settings are
+// passed through the environment.
+type settings struct {
+	// timeout is the time after which the init container gives up. Zero
+	// means waiting forever.
+	timeout time.Duration
+	// backoffInitial and backoffMax bound the exponential backoff between
+	// two attempts of a failing check.
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+	// terminationLog is the file Kubernetes reads the termination message
+	// from.
+	terminationLog string
+	// statusFile is the file the status of all relations is written to when
+	// the init container finishes. Empty means no status file is written.
+	statusFile string
+}
+
+// durationFromEnv parses the duration in the given environment variable, or
+// returns the fallback when the variable isn't set.
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("invalid %s: must not be negative", name)
+	}
+	return duration, nil
+}
+
+// loadSettings reads the settings from the environment.
+func loadSettings() (settings, error) {
+	var s settings
+	var err error
+	s.terminationLog = os.Getenv("TENGU_TERMINATION_LOG")
+	if s.terminationLog == "" {
+		s.terminationLog = "/dev/termination-log"
+	}
+	s.statusFile = os.Getenv("TENGU_STATUS_FILE")
+	if s.timeout, err = durationFromEnv("TENGU_TIMEOUT", 0); err != nil {
+		return s, err
+	}
+	if s.backoffInitial, err = durationFromEnv("TENGU_BACKOFF_INITIAL", time.Second); err != nil {
+		return s, err
+	}
+	if s.backoffMax, err = durationFromEnv("TENGU_BACKOFF_MAX", 30*time.Second); err != nil {
+		return s, err
+	}
+	if s.backoffInitial == 0 || s.backoffMax < s.backoffInitial {
+		return s, fmt.Errorf("invalid backoff: TENGU_BACKOFF_INITIAL must be positive and at most TENGU_BACKOFF_MAX")
+	}
+	return s, nil
+}
+
+// fail records the final status, writes the message to the termination log
+// and exits with the given code.
+func fail(s settings, report *status, code int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.WithField("exitCode", code).Error(message)
+	finish(s, report, false)
+	if err := ioutil.WriteFile(s.terminationLog, []byte(message), 0644); err != nil {
+		log.Errorf("Couldn't write termination log %v: %v", s.terminationLog, err)
+	}
+	os.Exit(code)
+}
+
+// finish records the end of the init container in the status file.
+func finish(s settings, report *status, satisfied bool) {
+	report.Satisfied = satisfied
+	report.FinishedAt = time.Now()
+	if err := report.write(s.statusFile); err != nil {
+		log.Errorf("Couldn't write status file %v: %v", s.statusFile, err)
+	}
+}
+
+// waitUntil blocks until the deadline has passed or the pod is stopped, and
+// returns true when the deadline has passed. A zero deadline blocks until the
+// pod is stopped.
+func waitUntil(deadline time.Time) bool {
+	// Sleeping forever
+	// https://stackoverflow.com/a/36419288/1588555
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
+	if deadline.IsZero() {
+		<-exitSignal
+		return false
+	}
+	select {
+	case <-exitSignal:
+		return false
+	case <-time.After(time.Until(deadline)):
+		return true
+	}
+}
+
+// retry calls attempt with exponential backoff until it succeeds, and returns
+// the number of attempts and the last error when the deadline passes first.
+func retry(s settings, deadline time.Time, logger *log.Entry, attempt func() error) (int, error) {
+	backoff := s.backoffInitial
+	for attempts := 1; ; attempts++ {
+		err := attempt()
+		if err == nil {
+			return attempts, nil
+		}
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			return attempts, err
+		}
+		logger.WithFields(log.Fields{
+			"attempt": attempts,
+			"backoff": backoff.String(),
+		}).WithError(err).Warn("Attempt failed; retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > s.backoffMax {
+			backoff = s.backoffMax
+		}
+	}
+}
+
+// relationFailure describes why the relation with the given name isn't
+// satisfied, by the exit code of waitForRelation. The timeout is only mentioned
+// when it caused the failure; without one the init container was stopped.
+func relationFailure(s settings, name string, code int) string {
+	message := fmt.Sprintf("Relation %v is not available", name)
+	if code == exitCheckFailed {
+		message = fmt.Sprintf("Check of relation %v failed", name)
+	}
+	if s.timeout > 0 {
+		message += fmt.Sprintf(" after %v", s.timeout)
+	}
+	return message
+}
+
+// waitForRelation waits until the required variable is set and its check
+// succeeds. When the relation isn't available, it returns the exit code of the
+// init container along with the status.
+func waitForRelation(s settings, source relationSource, deadline time.Time, name string) (result relationStatus, code int) {
+	start := time.Now()
+	result.Name = name
+	defer func() {
+		result.Duration = time.Since(start).String()
+	}()
+	logger := log.WithField("relation", name)
+
+	c, err := requirement.ParseCheck(os.Getenv("TENGU_CHECK_" + name))
+	if err != nil {
+		result.Outcome, result.Error = outcomeInvalid, fmt.Sprintf("invalid check: %v", err)
+		return result, exitInvalidConfig
+	}
+	result.Check = c.String()
+	logger = logger.WithField("check", result.Check)
+
+	value, ok, err := source.lookup(name)
+	result.Attempts = 1
+	if !ok && !source.live() {
+		// The environment of a running container never changes, so the
+		// variable only appears when the pod is recreated.
+		logger.Info("Variable not set; blocking")
+		result.Outcome, result.Error = outcomeMissing, "variable not set"
+		if !waitUntil(deadline) {
+			result.Error = "stopped while waiting: variable not set"
+		}
+		return result, exitMissingVar
+	}
+	if !ok || err != nil {
+		// Live sources are polled until the relation appears.
+		attempts, err := retry(s, deadline, logger, func() error {
+			value, ok, err = source.lookup(name)
+			if err == nil && !ok {
+				err = fmt.Errorf("variable not set")
+			}
+			return err
+		})
+		result.Attempts += attempts
+		if err != nil {
+			result.Outcome, result.Error = outcomeMissing, err.Error()
+			return result, exitMissingVar
+		}
+	}
+	result.Value = value
+
+	attempts, err := retry(s, deadline, logger.WithField("value", value), func() error {
+		return runCheck(c, value)
+	})
+	result.Attempts += attempts
+	if err != nil {
+		result.Outcome, result.Error = outcomeFailed, fmt.Sprintf("check %v of %v failed: %v", c, value, err)
+		return result, exitCheckFailed
+	}
+	result.Outcome = outcomeSatisfied
+	return result, 0
+}
+
 func main() {
-	requiredVars := os.Getenv("TENGU_REQUIRED_VARS")
-	for _, requiredVar := range strings.Split(requiredVars, ",") {
-		if _, ok := os.LookupEnv(requiredVar); !ok {
-			fmt.Printf("Var not found (%v) -> BLOCKING\n", requiredVar)
-
-			// Sleeping forever
-			// https://stackoverflow.com/a/36419288/1588555
-			exitSignal := make(chan os.Signal)
-			signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-			<-exitSignal
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+
+	report := &status{StartedAt: time.Now(), Relations: []relationStatus{}}
+	s, err := loadSettings()
+	if err != nil {
+		fail(s, report, exitInvalidConfig, "Invalid configuration: %v", err)
+	}
+	switch mode := os.Getenv("TENGU_MODE"); mode {
+	case "", "init":
+	case "sidecar":
+		runSidecar(s, report)
+		return
+	default:
+		fail(s, report, exitInvalidConfig, "Invalid configuration: unknown TENGU_MODE %q", mode)
+	}
+	source, err := newRelationSource()
+	if err != nil {
+		fail(s, report, exitInvalidConfig, "Invalid configuration: %v", err)
+	}
+	var deadline time.Time
+	if s.timeout > 0 {
+		deadline = time.Now().Add(s.timeout)
+	}
+
+	requirements, err := requirement.Parse(os.Getenv("TENGU_REQUIRED_VARS"))
+	if err != nil {
+		fail(s, report, exitInvalidConfig, "Invalid TENGU_REQUIRED_VARS: %v", err)
+	}
+	if len(requirements) == 0 {
+		log.Info("TENGU_REQUIRED_VARS is empty; no relations to wait for")
+	}
+	for _, requiredVar := range requirement.Vars(requirements) {
+		result, code := waitForRelation(s, source, deadline, requiredVar)
+		report.Relations = append(report.Relations, result)
+		if code != 0 {
+			result.logger().Error("Relation not available")
+			if code == exitInvalidConfig {
+				fail(s, report, code, "Invalid configuration of relation %v: %v", requiredVar, result.Error)
+			}
+			fail(s, report, code, "%v: %v", relationFailure(s, requiredVar, code), result.Error)
 		}
+		result.logger().Info("Relation satisfied")
 	}
-	fmt.Println("All variables found; shutting down..")
+	finish(s, report, true)
+	log.Info("All relations satisfied; shutting down")
 }
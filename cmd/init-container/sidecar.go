@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/reload"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+)
+
+// envFileName is the file in the output directory that holds all relations as
+// `KEY=value` lines, so a shell can source it.
+const envFileName = "relations.env"
+
+// sidecarSettings holds the configuration of the sidecar mode. All settings
+// are passed through the environment.
+type sidecarSettings struct {
+	// watchVars are the variables of all relations of the consumer.
+	watchVars []string
+	// outputDir is the shared volume the relations are written to.
+	outputDir string
+	// reload tells how the application is notified of changes.
+	reload reload.Reload
+	// syncPeriod is the time between two lookups of the relations.
+	syncPeriod time.Duration
+}
+
+// loadSidecarSettings reads the settings of the sidecar mode from the
+// environment.
+func loadSidecarSettings() (sidecarSettings, error) {
+	var s sidecarSettings
+	requirements, err := requirement.Parse(os.Getenv("TENGU_WATCH_VARS"))
+	if err != nil {
+		return s, fmt.Errorf("invalid TENGU_WATCH_VARS: %v", err)
+	}
+	s.watchVars = requirement.Vars(requirements)
+	s.outputDir = os.Getenv("TENGU_OUTPUT_DIR")
+	if s.outputDir == "" {
+		s.outputDir = "/etc/tengu/live"
+	}
+	reloadConfig := os.Getenv("TENGU_RELOAD")
+	if reloadConfig == "" {
+		reloadConfig = reload.Files
+	}
+	if s.reload, err = reload.Parse(reloadConfig); err != nil {
+		return s, fmt.Errorf("invalid TENGU_RELOAD: %v", err)
+	}
+	if s.syncPeriod, err = durationFromEnv("TENGU_SYNC_PERIOD", 5*time.Second); err != nil {
+		return s, err
+	}
+	if s.syncPeriod == 0 {
+		return s, fmt.Errorf("invalid TENGU_SYNC_PERIOD: must be positive")
+	}
+	return s, nil
+}
+
+// runSidecar keeps the relations of the consumer up to date in the output
+// directory and notifies the application of every change, until the pod is
+// stopped.
+func runSidecar(s settings, report *status) {
+	config, err := loadSidecarSettings()
+	if err != nil {
+		fail(s, report, exitInvalidConfig, "Invalid configuration: %v", err)
+	}
+	source, err := newRelationSource()
+	if err != nil {
+		fail(s, report, exitInvalidConfig, "Invalid configuration: %v", err)
+	}
+	log.WithFields(log.Fields{
+		"relations": config.watchVars,
+		"reload":    config.reload.String(),
+	}).Info("Watching relations")
+
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(config.syncPeriod)
+	defer ticker.Stop()
+
+	var current map[string]string
+	notifyPending := false
+	for {
+		relations, err := lookupAll(source, config.watchVars)
+		if err != nil {
+			log.WithError(err).Warn("Couldn't read relations")
+		} else if current == nil || !reflect.DeepEqual(relations, current) {
+			if err := writeRelations(config.outputDir, relations, current); err != nil {
+				log.WithError(err).Error("Couldn't write relations")
+			} else {
+				log.WithField("relations", relations).Info("Relations changed")
+				// the application reads the relations when it starts, so
+				// only later changes are notified
+				notifyPending = notifyPending || current != nil
+				current = relations
+			}
+		}
+		if notifyPending {
+			if err := notify(config.reload); err != nil {
+				log.WithError(err).Warn("Couldn't notify the application; retrying")
+			} else {
+				log.WithField("reload", config.reload.String()).Info("Notified the application")
+				notifyPending = false
+			}
+		}
+		select {
+		case <-exitSignal:
+			log.Info("Stopped; shutting down")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lookupAll returns the values of the variables that are set.
+func lookupAll(source relationSource, names []string) (map[string]string, error) {
+	relations := make(map[string]string)
+	for _, name := range names {
+		value, ok, err := source.lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			relations[name] = value
+		}
+	}
+	return relations, nil
+}
+
+// writeRelations writes every relation to its own file in the directory and
+// all relations to the env file. The files of relations that are gone are
+// removed.
+func writeRelations(dir string, relations, previous map[string]string) error {
+	names := make([]string, 0, len(relations))
+	for name := range relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var env strings.Builder
+	for _, name := range names {
+		if err := writeFileAtomic(filepath.Join(dir, name), []byte(relations[name])); err != nil {
+			return err
+		}
+		fmt.Fprintf(&env, "%s=%s\n", name, relations[name])
+	}
+	for name := range previous {
+		if _, ok := relations[name]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(dir, envFileName), []byte(env.String()))
+}
+
+// notify tells the application that its relations changed.
+func notify(r reload.Reload) error {
+	switch r.Kind {
+	case reload.SIGHUP:
+		return signalProcess(r.Process, syscall.SIGHUP)
+	case reload.HTTP:
+		client := http.Client{Timeout: checkTimeout}
+		resp, err := client.Post(r.URL, "text/plain", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	return nil
+}
+
+// signalProcess sends the signal to all processes with the given name. The
+// name is matched against the base name of the executable in the command line
+// of the process, since the kernel truncates the name in `comm` to 15
+// characters. `comm` is matched as well, so scripts with a short name are
+// found too. It needs a process namespace that is shared with the
+// application.
+func signalProcess(name string, sig syscall.Signal) error {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	signalled := 0
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			// gone, or a kernel thread without a command line
+			continue
+		}
+		argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+		comm, _ := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "comm"))
+		if filepath.Base(argv0) != name && strings.TrimSpace(string(comm)) != name {
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			return fmt.Errorf("signalling process %d: %v", pid, err)
+		}
+		signalled++
+	}
+	if signalled == 0 {
+		return fmt.Errorf("no process named %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceAccountDir holds the credentials of the pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// relationSource looks up the value of a required variable.
+type relationSource interface {
+	// lookup returns the value of the variable and whether it is set.
+	lookup(name string) (string, bool, error)
+	// live returns true when a missing variable may still appear while the
+	// init container is running.
+	live() bool
+}
+
+// newRelationSource creates the source selected by TENGU_RELATIONS_SOURCE.
+func newRelationSource() (relationSource, error) {
+	switch source := os.Getenv("TENGU_RELATIONS_SOURCE"); source {
+	case "", "env":
+		return envSource{}, nil
+	case "volume":
+		dir := os.Getenv("TENGU_RELATIONS_DIR")
+		if dir == "" {
+			dir = "/etc/tengu/relations"
+		}
+		return volumeSource{dir: dir}, nil
+	case "api":
+		name := os.Getenv("TENGU_RELATIONS_CONFIGMAP")
+		if name == "" {
+			return nil, fmt.Errorf("TENGU_RELATIONS_CONFIGMAP must be set for source %q", source)
+		}
+		return newAPISource(name)
+	default:
+		return nil, fmt.Errorf("unknown TENGU_RELATIONS_SOURCE %q", source)
+	}
+}
+
+// envSource reads the variables from the environment, which is fixed when the
+// pod is created.
+type envSource struct{}
+
+func (envSource) lookup(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	return value, ok, nil
+}
+
+func (envSource) live() bool {
+	return false
+}
+
+// volumeSource reads the variables from the files in a mounted ConfigMap or
+// downward API volume. The kubelet updates these files while the pod runs.
+type volumeSource struct {
+	dir string
+}
+
+func (v volumeSource) lookup(name string) (string, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(v.dir, name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func (volumeSource) live() bool {
+	return true
+}
+
+// apiSource reads the variables from the relations ConfigMap of the consumer
+// using the Kubernetes API. The service account of the pod needs permission to
+// get the ConfigMap.
+type apiSource struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+// newAPISource creates a source for the ConfigMap with the given name in the
+// namespace of the pod.
+func newAPISource(name string) (*apiSource, error) {
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	caData, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	return &apiSource{
+		client: &http.Client{
+			Timeout:   checkTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:   fmt.Sprintf("https://%s/api/v1/namespaces/%s/configmaps/%s", host, strings.TrimSpace(string(namespace)), name),
+		token: strings.TrimSpace(string(token)),
+	}, nil
+}
+
+func (a *apiSource) lookup(name string) (string, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, a.url, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// The controller creates the ConfigMap once a relation is available.
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("getting relations ConfigMap: unexpected status %s", resp.Status)
+	}
+	var configMap struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&configMap); err != nil {
+		return "", false, err
+	}
+	value, ok := configMap.Data[name]
+	return value, ok, nil
+}
+
+func (*apiSource) live() bool {
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Outcomes of waiting for a relation.
+const (
+	outcomeSatisfied = "satisfied"
+	outcomeMissing   = "missing"
+	outcomeFailed    = "failed"
+	outcomeInvalid   = "invalid"
+)
+
+// relationStatus is the outcome of waiting for a single required relation.
+// Attempts counts both the lookups of the variable and the runs of its check.
+type relationStatus struct {
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+	Check    string `json:"check,omitempty"`
+	Outcome  string `json:"outcome"`
+	Attempts int    `json:"attempts"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// logger returns a logger with the status of the relation as fields.
+func (r relationStatus) logger() *log.Entry {
+	fields := log.Fields{
+		"relation": r.Name,
+		"outcome":  r.Outcome,
+		"attempts": r.Attempts,
+		"duration": r.Duration,
+	}
+	if r.Value != "" {
+		fields["value"] = r.Value
+	}
+	if r.Check != "" {
+		fields["check"] = r.Check
+	}
+	if r.Error != "" {
+		fields["error"] = r.Error
+	}
+	return log.WithFields(fields)
+}
+
+// status is the outcome of the init container. It is written to the status
+// file so the other containers of the pod can see which relations were
+// satisfied when the pod started.
+type status struct {
+	Satisfied  bool             `json:"satisfied"`
+	StartedAt  time.Time        `json:"startedAt"`
+	FinishedAt time.Time        `json:"finishedAt"`
+	Relations  []relationStatus `json:"relations"`
+}
+
+// write writes the status to the given file, if any.
+func (s *status) write(file string) error {
+	if file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
+
+// writeFileAtomic replaces the file with the given data atomically, so readers
+// never see a partially written file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -5,8 +5,6 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
@@ -17,12 +15,17 @@ import (
 // Controller struct defines how a controller should encapsulate
 // logging, client connectivity, informing (list and watching)
 // queueing, and handling of resource changes
+//
+// the queue holds the keys of consumer deployments and provider services;
+// changes to providers are mapped to the keys of their consumers before
+// they are queued
 type Controller struct {
-	logger    *log.Entry
-	clientset kubernetes.Interface
-	queue     workqueue.RateLimitingInterface
-	informer  cache.SharedIndexInformer
-	handler   Handler
+	logger             *log.Entry
+	clientset          kubernetes.Interface
+	queue              workqueue.RateLimitingInterface
+	serviceInformer    cache.SharedIndexInformer
+	deploymentInformer cache.SharedIndexInformer
+	handler            Handler
 }
 
 // Run is the main path of execution for the controller loop
@@ -35,8 +38,9 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 
 	c.logger.Info("Controller.Run: initiating")
 
-	// run the informer to start listing and watching resources
-	go c.informer.Run(stopCh)
+	// run the informers to start listing and watching resources
+	go c.serviceInformer.Run(stopCh)
+	go c.deploymentInformer.Run(stopCh)
 
 	// do the initial synchronization (one time) to populate resources
 	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
@@ -57,9 +61,9 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 }
 
 // HasSynced allows us to satisfy the Controller interface
-// by wiring up the informer's HasSynced method to it
+// by wiring up the informers' HasSynced methods to it
 func (c *Controller) HasSynced() bool {
-	return c.informer.HasSynced()
+	return c.serviceInformer.HasSynced() && c.deploymentInformer.HasSynced()
 }
 
 // runWorker executes the loop to process new items added to the queue
@@ -75,9 +79,8 @@ func (c *Controller) runWorker() {
 	log.Info("Controller.runWorker: completed")
 }
 
-// processNextItem retrieves each queued item and takes the
-// necessary handler action based off of if the item was
-// created or deleted
+// processNextItem retrieves each queued key and lets the handler
+// reconcile the consumer or provider it refers to
 func (c *Controller) processNextItem() bool {
 	log.Info("Controller.processNextItem: start")
 
@@ -95,20 +98,24 @@ func (c *Controller) processNextItem() bool {
 
 	defer c.queue.Done(key)
 
-	// assert the string out of the key (format `namespace/name`)
-	keyRaw := key.(string)
-
-	// take the string key and get the object out of the indexer
-	//
-	// item will contain the complex object for the resource and
-	// exists is a bool that'll indicate whether or not the
-	// resource was created (true) or deleted (false)
+	// reconcile the consumer with the desired state of all its relations,
+	// or the provider with its finalizer. both kinds of keys have the
+	// format `namespace/name`
 	//
-	// if there is an error in getting the key from the index
-	// then we want to retry this particular queue key a certain
-	// number of times (5 here) before we forget the queue key
-	// and throw an error
-	item, exists, err := c.informer.GetIndexer().GetByKey(keyRaw)
+	// if reconciling fails then we want to retry this particular queue
+	// key a certain number of times (5 here) before we forget the queue
+	// key and throw an error
+	var err error
+	switch keyRaw := key.(type) {
+	case providerKey:
+		c.logger.Infof("Controller.processNextItem: reconciling provider: %s", keyRaw)
+		err = c.handler.ReconcileProvider(string(keyRaw))
+	case string:
+		c.logger.Infof("Controller.processNextItem: reconciling consumer: %s", keyRaw)
+		err = c.handler.Reconcile(keyRaw)
+	default:
+		c.logger.Errorf("Controller.processNextItem: unknown key type %T", key)
+	}
 	if err != nil {
 		if c.queue.NumRequeues(key) < 5 {
 			c.logger.Errorf("Controller.processNextItem: Failed processing item with key %s with error %v, retrying", key, err)
@@ -118,35 +125,12 @@ func (c *Controller) processNextItem() bool {
 			c.queue.Forget(key)
 			utilruntime.HandleError(err)
 		}
+		return true
 	}
 
-	// if the item doesn't exist then it was deleted and we need to fire off the handler's
-	// ObjectDeleted method. but if the object does exist that indicates that the object
-	// was created (or updated) so run the ObjectCreated method
-	//
-	// after both instances, we want to forget the key from the queue, as this indicates
-	// a code path of successful queue key processing
-	if !exists {
-		c.logger.Infof("Controller.processNextItem: object deleted detected: %s", keyRaw)
-		c.handler.ObjectDeleted(item)
-		c.queue.Forget(key)
-	} else {
-		c.logger.Infof("Controller.processNextItem: object created detected: %s", keyRaw)
-		switch tItem := item.(type) {
-		case *corev1.Service:
-			c.logger.Infof("Object is of type Service")
-			c.handler.ServiceCreated(tItem)
-			// here v has type T
-		case *appsv1.Deployment:
-			c.logger.Infof("Object is of type Deployment")
-			c.handler.DeploymentCreated(tItem)
-			// here v has type S
-		default:
-			c.logger.Infof("Object is of unknown type ")
-			// no match; here v has the same type as i
-		}
-		c.queue.Forget(key)
-	}
+	// forget the key from the queue, as this indicates a code path of
+	// successful queue key processing
+	c.queue.Forget(key)
 
 	// keep the worker loop running by returning true
 	return true
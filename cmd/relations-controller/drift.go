@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/deploymentpatch"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/orconlib"
+)
+
+// initContainerDrift describes a consumer that lost the init container the
+// webhook injected in it.
+const initContainerDrift = "init container is missing"
+
+// detectDrift compares the consumer with the relation state that was injected
+// in it earlier and describes every difference. Differences are caused by
+// manual edits of the consumer, such as stripping injected variables.
+func detectDrift(deployment *appsv1.Deployment, desired map[orconlib.RolloutPolicy]map[string]string) []string {
+	var drift []string
+	podSpec := deployment.Spec.Template.Spec
+
+	for _, injected := range injectedVars(deployment) {
+		if !envDesired(desired, injected) {
+			// the relation departed, Reconcile removes the variable
+			continue
+		}
+		for _, container := range podSpec.Containers {
+			if !hasEnvVar(container, injected) {
+				drift = append(drift, fmt.Sprintf("variable %s is missing from container %s", injected, container.Name))
+			}
+		}
+	}
+
+	if len(desired[orconlib.PolicyConfigMap]) > 0 {
+		mounted := false
+		for _, volume := range podSpec.Volumes {
+			if volume.Name == orconlib.RelationsVolumeName {
+				mounted = true
+			}
+		}
+		if !mounted {
+			drift = append(drift, fmt.Sprintf("volume %s is missing", orconlib.RelationsVolumeName))
+		}
+	}
+
+	if strings.ToLower(deployment.Annotations["injector.tengu.io/status"]) == "injected" {
+		gated := false
+		for _, container := range podSpec.InitContainers {
+			if hasEnvVar(container, "TENGU_REQUIRED_VARS") {
+				gated = true
+			}
+		}
+		if !gated {
+			drift = append(drift, initContainerDrift)
+		}
+	}
+	return drift
+}
+
+// hasEnvVar returns true when the container has an environment variable with
+// the given name.
+func hasEnvVar(container corev1.Container, name string) bool {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// repairDrift reports the drift of the consumer and adds the changes to the
+// patch that Reconcile doesn't make on its own. Missing variables and volumes
+// are added again by Reconcile. The init container is owned by the webhook, so
+// the injection status is removed to let the webhook inject it again when it
+// admits the patched consumer.
+func (t *TestHandler) repairDrift(origDeployment *appsv1.Deployment, deployment *deploymentpatch.DeploymentPatch, drift []string, ctxLog *log.Entry) {
+	for _, difference := range drift {
+		ctxLog.Warnf("Drift detected: %s", difference)
+		if difference == initContainerDrift {
+			deployment.RemoveFromAnnotations([]string{"injector.tengu.io/status"})
+		}
+	}
+	t.recorder.Eventf(origDeployment, corev1.EventTypeWarning, "RelationDrift",
+		"Repairing relation state: %s", strings.Join(drift, "; "))
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/deploymentpatch"
 	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/orconlib"
@@ -18,129 +25,226 @@ import (
 // Handler interface contains the methods that are required
 type Handler interface {
 	Init() error
-	ServiceCreated(obj interface{})
-	DeploymentCreated(obj interface{})
-	ObjectDeleted(obj interface{})
-	ObjectUpdated(objOld, objNew interface{})
+	Reconcile(key string) error
+	ReconcileProvider(key string) error
 }
 
 // TestHandler is a sample implementation of Handler
 type TestHandler struct {
-	clientset kubernetes.Interface
+	clientset   kubernetes.Interface
+	recorder    record.EventRecorder
+	services    cache.Indexer
+	deployments cache.Indexer
+	// queue is used to revisit consumers whose debounce window hasn't
+	// passed yet.
+	queue workqueue.DelayingInterface
+
+	// mu guards debounced, which holds the time at which the debounced
+	// relations of a consumer may be rolled out, keyed by `namespace/name`.
+	mu        sync.Mutex
+	debounced map[string]time.Time
 }
 
 // Init handles any handler initialization
 func (t *TestHandler) Init() error {
 	log.Info("TestHandler.Init")
+	t.debounced = make(map[string]time.Time)
 	return nil
 }
 
-func (t *TestHandler) addProvidesAsEnvVar(services []*corev1.Service, deployments *[]appsv1.Deployment, ctxLog *log.Entry) {
-	// relationConfig := map[string]string{
-	// 	strings.ToUpper(service.Labels["tengu.io/provides"]): service.Spec.ExternalName,
-	// }
-	relationConfig := make(map[string]string)
-	for _, service := range services {
-		relationConfig[strings.ToUpper(service.Labels["tengu.io/provides"])] = service.Spec.ExternalName
-	}
-	for _, origDeployment := range *deployments {
-		deployment := deploymentpatch.New(origDeployment)
-		deployment.AppendToPodEnvironment(relationConfig)
-		// TODO: The next line is only for benchmarking, remove
-		// after benchmarks are finished.
-		deployment.AppendToPodLabels(relationConfig)
-		patch, err := deployment.GetPatchBytes()
+// relationGeneration returns a short, deterministic id for the given relation
+// data so a rollout can be traced back to the relation change that caused it.
+func relationGeneration(relationConfig map[string]string) string {
+	keys := make([]string, 0, len(relationConfig))
+	for key := range relationConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", key, relationConfig[key])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))[:12]
+}
+
+// appendEnvironment adds the relation data to the environment of the pod
+// template.
+func appendEnvironment(origDeployment appsv1.Deployment, deployment *deploymentpatch.DeploymentPatch, relationConfig map[string]string) {
+	if envUpToDate(origDeployment, relationConfig) {
+		return
+	}
+	deployment.AppendToPodEnvironment(relationConfig)
+	// Tracing is opt-in: only annotate the pod template when the environment
+	// actually changes so tracing never causes an extra rollout on its own.
+	if origDeployment.Annotations["tengu.io/tracing"] == "true" {
+		deployment.AppendToPodAnnotations(map[string]string{
+			"tengu.io/relation-generation": relationGeneration(relationConfig),
+		})
+	}
+}
+
+// injectedVars returns the environment variables the controller injected in
+// the deployment, as recorded in its `tengu.io/injected-vars` annotation.
+func injectedVars(deployment *appsv1.Deployment) []string {
+	annotation := deployment.Annotations["tengu.io/injected-vars"]
+	if annotation == "" {
+		return []string{}
+	}
+	return strings.Split(annotation, ",")
+}
+
+// applyPatch sends the patch of the deployment to the API server.
+func (t *TestHandler) applyPatch(origDeployment appsv1.Deployment, deployment *deploymentpatch.DeploymentPatch, ctxLog *log.Entry) error {
+	patch, err := deployment.GetPatchBytes()
+	if err != nil {
+		ctxLog.Errorf("Patching failed, cannot encode patch %v", err)
+		return err
+	}
+	if len(patch) == 0 {
+		ctxLog.Infof("Nothing to patch..")
+		return nil
+	}
+	ctxLog.WithField("patch", string(patch)).Infof("Patching deployment..")
+	_, err = t.clientset.AppsV1().Deployments(origDeployment.Namespace).Patch(
+		origDeployment.Name,
+		types.JSONPatchType,
+		patch,
+	)
+	if err != nil {
+		ctxLog.Errorf("Patching deployment failed: %v", err)
+		return err
+	}
+	ctxLog.Infof("Patching deployment succeeded")
+	return nil
+}
+
+// relatedServices returns the provider services listed in the
+// `tengu.io/relations` annotation of the deployment that currently exist and
+// aren't departing.
+func (t *TestHandler) relatedServices(deployment *appsv1.Deployment, ctxLog *log.Entry) ([]*corev1.Service, error) {
+	var services []*corev1.Service
+	serviceNames := deployment.Annotations["tengu.io/relations"]
+	if serviceNames == "" {
+		return services, nil
+	}
+	for _, serviceName := range strings.Split(serviceNames, ",") {
+		item, exists, err := t.services.GetByKey(deployment.Namespace + "/" + serviceName)
 		if err != nil {
-			ctxLog.Errorf("Patching failed, cannot encode patch %v", err)
-			continue
+			return nil, err
 		}
-		if len(patch) == 0 {
-			ctxLog.Infof("Nothing to patch..")
+		if !exists {
+			ctxLog.Infof("Service %v doesn't exist (yet)", serviceName)
 			continue
 		}
-		ctxLog.WithField("patch", string(patch)).Infof("Patching deployment..")
-		_, err = t.clientset.AppsV1().Deployments("k8s-tengu-test").Patch(
-			origDeployment.Name,
-			types.JSONPatchType,
-			patch,
-		)
-		if err != nil {
-			ctxLog.Errorf("Patching deployment failed: %v", err)
-		} else {
-			ctxLog.Infof("Patching deployment succeeded")
+		if departing(item.(*corev1.Service)) {
+			ctxLog.Infof("Service %v is departing", serviceName)
+			continue
 		}
+		services = append(services, item.(*corev1.Service))
 	}
+	return services, nil
 }
 
-// ServiceCreated is called when a service is created
-func (t *TestHandler) ServiceCreated(obj interface{}) {
-	// assert the type to a Service object to pull out relevant data
-	service := obj.(*corev1.Service)
-	ctxLog := log.WithFields(log.Fields{
-		// '-' prefix is here so these fields are shown first in output
-		"-name-watched":            service.Name,
-		"-type-watched":            "Service",
-		"-resourceVersion-watched": service.ResourceVersion,
-	})
-	ctxLog.Info("TestHandler.ServiceCreated")
-
-	ctxLog.WithField("ExternalName", service.Spec.ExternalName).Infof("")
-
-	deployments := orconlib.GetRelatedDeploymentsAnnotations(service.Name, t.clientset)
-	ctxLog.Infof("Found %v related deployments.", len(*deployments))
-	services := []*corev1.Service{service}
-	t.addProvidesAsEnvVar(services, deployments, ctxLog)
-}
-
-// DeploymentCreated is called when an deployment is created
-func (t *TestHandler) DeploymentCreated(obj interface{}) {
-	// assert the type to a Service object to pull out relevant data
-	deployment := obj.(*appsv1.Deployment)
+// Reconcile computes the complete relation state the consumer with the given
+// key should have and converges the consumer to it. Relation data that is new
+// or changed is added, and variables that were injected for relations that
+// are gone are removed.
+func (t *TestHandler) Reconcile(key string) error {
+	item, exists, err := t.deployments.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Infof("TestHandler.Reconcile: consumer %s is gone", key)
+		t.mu.Lock()
+		delete(t.debounced, key)
+		t.mu.Unlock()
+		return nil
+	}
+	origDeployment := item.(*appsv1.Deployment)
 	ctxLog := log.WithFields(log.Fields{
 		// '-' prefix is here so these fields are shown first in output
-		"-name-watched":            deployment.Name,
+		"-name-watched":            origDeployment.Name,
 		"-type-watched":            "Deployment",
-		"-resourceVersion-watched": deployment.ResourceVersion,
+		"-resourceVersion-watched": origDeployment.ResourceVersion,
 	})
-	ctxLog.Infof("TestHandler.DeploymentCreated")
-
-	// servicename := deployment.Labels["tengu.io/relations"]
-	// if servicename == "" {
-	// 	ctxLog.Infof("Deployment has no relationships.")
-	// 	return
-	// }
-	// service, err := t.clientset.CoreV1().Services("k8s-tengu-test").Get(servicename, metav1.GetOptions{})
-	// if err != nil {
-	// 	ctxLog.Warnf("Couldn't get service %v: %v", servicename, err)
-	// 	return
-	// }
-	// deployments := []appsv1.Deployment{*deployment}
-	// t.addBaseURL(service, &deployments, ctxLog)
+	ctxLog.Infof("TestHandler.Reconcile")
 
-	serviceNames := deployment.Annotations["tengu.io/relations"]
-	if serviceNames == "" {
-		ctxLog.Infof("Deployment has no relationships.")
-		return
+	services, err := t.relatedServices(origDeployment, ctxLog)
+	if err != nil {
+		return err
 	}
-	var services []*corev1.Service
-	for _, serviceName := range strings.Split(serviceNames, ",") {
-		service, err := t.clientset.CoreV1().Services("k8s-tengu-test").Get(serviceName, metav1.GetOptions{})
-		if err != nil {
-			ctxLog.Warnf("Couldn't get service %v: %v", serviceName, err)
+	desired := relationConfigByPolicy(services, origDeployment)
+	live := orconlib.LiveRelations(origDeployment.Annotations)
+	if live {
+		// the containers of live consumers read all relations from the
+		// relations ConfigMap the webhook mounted in them, so relation
+		// changes never cause a rollout and rollout policies don't apply
+		configMapData := make(map[string]string)
+		for _, relationConfig := range desired {
+			for relationKey, value := range relationConfig {
+				configMapData[relationKey] = value
+			}
+		}
+		desired = map[orconlib.RolloutPolicy]map[string]string{orconlib.PolicyConfigMap: configMapData}
+	}
+	deployment := deploymentpatch.New(*origDeployment)
+	if drift := detectDrift(origDeployment, desired); len(drift) > 0 {
+		t.repairDrift(origDeployment, deployment, drift, ctxLog)
+	}
+
+	environment := make(map[string]string)
+	for relationKey, value := range desired[orconlib.PolicyImmediate] {
+		environment[relationKey] = value
+	}
+	for relationKey, value := range approveManual(*origDeployment, deployment, desired[orconlib.PolicyManual], ctxLog) {
+		environment[relationKey] = value
+	}
+	for relationKey, value := range t.debounce(key, *origDeployment, desired[orconlib.PolicyDebounce], ctxLog) {
+		environment[relationKey] = value
+	}
+	// the webhook already mounted the ConfigMap in live consumers
+	mount := !live && len(desired[orconlib.PolicyConfigMap]) > 0
+	if err := t.updateRelationsConfigMap(*origDeployment, deployment, desired[orconlib.PolicyConfigMap], mount, ctxLog); err != nil {
+		return err
+	}
+	appendEnvironment(*origDeployment, deployment, environment)
+
+	// Remove the variables of relations that are gone and keep track of the
+	// variables that remain injected.
+	var removed, remaining []string
+	for _, injected := range injectedVars(origDeployment) {
+		if envDesired(desired, injected) {
+			remaining = append(remaining, injected)
 		} else {
-			services = append(services, service)
+			removed = append(removed, injected)
 		}
 	}
-	deployments := []appsv1.Deployment{*deployment}
-	t.addProvidesAsEnvVar(services, &deployments, ctxLog)
-}
+	for relationKey := range environment {
+		if !containsString(remaining, relationKey) {
+			remaining = append(remaining, relationKey)
+		}
+	}
+	sort.Strings(remaining)
+	if len(removed) > 0 {
+		ctxLog.Infof("Removing variables of departed relations: %v", removed)
+		deployment.RemoveFromPodEnvironment(removed)
+	}
+	if injected := strings.Join(remaining, ","); injected != origDeployment.Annotations["tengu.io/injected-vars"] {
+		deployment.AppendToAnnotations(map[string]string{
+			"tengu.io/injected-vars": injected,
+		})
+	}
 
-// ObjectDeleted is called when an object is deleted
-func (t *TestHandler) ObjectDeleted(obj interface{}) {
-	log.Info("TestHandler.ObjectDeleted")
+	return t.applyPatch(*origDeployment, deployment, ctxLog)
 }
 
-// ObjectUpdated is called when an object is updated
-func (t *TestHandler) ObjectUpdated(objOld, objNew interface{}) {
-	log.Info("TestHandler.ObjectUpdated")
+// containsString returns true when the value is in the list of values.
+func containsString(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	appsv1 "k8s.io/api/apps/v1"
@@ -12,9 +15,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -42,8 +48,31 @@ func getKubernetesClient() kubernetes.Interface {
 	return client
 }
 
+// relationsIndex is the name of the deployment informer index that maps
+// provider services to the consumers that have a relation with them.
+const relationsIndex = "relations"
+
+// indexByRelations indexes a deployment by the `namespace/name` keys of the
+// services listed in its `tengu.io/relations` annotation.
+func indexByRelations(obj interface{}) ([]string, error) {
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok || deployment.Annotations["tengu.io/relations"] == "" {
+		return []string{}, nil
+	}
+	var keys []string
+	for _, serviceName := range strings.Split(deployment.Annotations["tengu.io/relations"], ",") {
+		keys = append(keys, deployment.Namespace+"/"+serviceName)
+	}
+	return keys, nil
+}
+
 // main code path
 func main() {
+	var coalesceWindow, resyncPeriod time.Duration
+	flag.DurationVar(&coalesceWindow, "coalesce-window", 2*time.Second, "Time to collect changes for a consumer before reconciling it in a single patch.")
+	flag.DurationVar(&resyncPeriod, "resync-period", 5*time.Minute, "Period after which all consumers are reconciled again to repair drift. 0 disables resyncing.")
+	flag.Parse()
+
 	// log.SetFormatter(&log.JSONFormatter{})
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
@@ -72,7 +101,7 @@ func main() {
 			},
 		},
 		&apiv1.Service{}, // the target type (Service)
-		0,                // no resync (period of 0)
+		resyncPeriod,     // periodically resync to repair drift
 		cache.Indexers{},
 	)
 	deploymentInformer := cache.NewSharedIndexInformer(
@@ -93,16 +122,37 @@ func main() {
 				return client.AppsV1().Deployments("k8s-tengu-test").Watch(options)
 			},
 		},
-		&appsv1.Deployment{}, // the target type (Pod)
-		0,                    // no resync (period of 0)
-		cache.Indexers{},
+		&appsv1.Deployment{}, // the target type (Deployment)
+		resyncPeriod,         // periodically resync to repair drift
+		cache.Indexers{relationsIndex: indexByRelations},
 	)
 
 	// create a new queue so that when the informer gets a resource that is either
 	// a result of listing or watching, we can add an idenfitying key to the queue
 	// so that it can be handled in the handler
-	serviceQueue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-	deploymentQueue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	//
+	// changes to a provider enqueue the consumers that have a relation with
+	// it. consumer keys are added after the coalesce window, and the queue
+	// drops keys that are already waiting, so a burst of changes results in a
+	// single patch per consumer. provider keys are only queued to manage the
+	// finalizer of the provider.
+	consumerQueue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	// enqueueConsumers adds the consumers of the given service to the queue
+	enqueueConsumers := func(serviceKey string) {
+		consumers, err := deploymentInformer.GetIndexer().ByIndex(relationsIndex, serviceKey)
+		if err != nil {
+			log.Errorf("Looking up consumers of service %s failed: %v", serviceKey, err)
+			return
+		}
+		for _, consumer := range consumers {
+			key, err := cache.MetaNamespaceKeyFunc(consumer)
+			if err == nil {
+				log.Infof("Enqueue consumer %s of service %s", key, serviceKey)
+				consumerQueue.AddAfter(key, coalesceWindow)
+			}
+		}
+	}
 
 	// add event handlers to handle the three types of events for resources:
 	//  - adding new resources
@@ -115,15 +165,16 @@ func main() {
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			log.Infof("Add service: %s", key)
 			if err == nil {
-				// add the key to the queue for the handler to get
-				serviceQueue.Add(key)
+				consumerQueue.Add(providerKey(key))
+				enqueueConsumers(key)
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(newObj)
 			log.Infof("Update service: %s", key)
 			if err == nil {
-				serviceQueue.Add(key)
+				consumerQueue.Add(providerKey(key))
+				enqueueConsumers(key)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
@@ -134,8 +185,17 @@ func main() {
 			// this then in turn calls MetaNamespaceKeyFunc
 			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 			log.Infof("Delete service: %s", key)
-			if err == nil {
-				serviceQueue.Add(key)
+			if err != nil {
+				return
+			}
+			enqueueConsumers(key)
+			// the watch also reports a delete when the service loses the
+			// `tengu.io/provides` label. such a service still holds the
+			// finalizer, so let the handler release it. the final state of a
+			// tombstone is unknown, so the handler checks it as well.
+			service, ok := obj.(*apiv1.Service)
+			if !ok || (!departing(service) && hasFinalizer(service)) {
+				consumerQueue.Add(providerKey(key))
 			}
 		},
 	})
@@ -145,17 +205,17 @@ func main() {
 			// convert the resource object into a key (in this case
 			// we are just doing it in the format of 'namespace/name')
 			key, err := cache.MetaNamespaceKeyFunc(obj)
-			log.Infof("Add pod: %s", key)
+			log.Infof("Add deployment: %s", key)
 			if err == nil {
 				// add the key to the queue for the handler to get
-				deploymentQueue.Add(key)
+				consumerQueue.AddAfter(key, coalesceWindow)
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(newObj)
-			log.Infof("Update pod: %s", key)
+			log.Infof("Update deployment: %s", key)
 			if err == nil {
-				deploymentQueue.Add(key)
+				consumerQueue.AddAfter(key, coalesceWindow)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
@@ -165,34 +225,40 @@ func main() {
 			//
 			// this then in turn calls MetaNamespaceKeyFunc
 			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-			log.Infof("Delete pod: %s", key)
+			log.Infof("Delete deployment: %s", key)
 			if err == nil {
-				deploymentQueue.Add(key)
+				consumerQueue.Add(key)
 			}
 		},
 	})
 
+	// record events on the consumers so drift repairs are visible to users
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(log.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: "relations-controller"})
+
+	handler := &TestHandler{
+		clientset:   client,
+		recorder:    recorder,
+		services:    serviceInformer.GetIndexer(),
+		deployments: deploymentInformer.GetIndexer(),
+		queue:       consumerQueue,
+	}
+	if err := handler.Init(); err != nil {
+		log.Fatalf("Handler initialization failed: %v", err)
+	}
+
 	// construct the Controller object which has all of the necessary components to
 	// handle logging, connections, informing (listing and watching), the queue,
 	// and the handler
-	serviceController := Controller{
-		logger:    log.NewEntry(log.StandardLogger()),
-		clientset: client,
-		informer:  serviceInformer,
-		queue:     serviceQueue,
-		handler: &TestHandler{
-			clientset: client,
-		},
-	}
-
-	deploymentController := Controller{
-		logger:    log.NewEntry(log.StandardLogger()),
-		clientset: client,
-		informer:  deploymentInformer,
-		queue:     deploymentQueue,
-		handler: &TestHandler{
-			clientset: client,
-		},
+	controller := Controller{
+		logger:             log.NewEntry(log.StandardLogger()),
+		clientset:          client,
+		serviceInformer:    serviceInformer,
+		deploymentInformer: deploymentInformer,
+		queue:              consumerQueue,
+		handler:            handler,
 	}
 
 	// use a channel to synchronize the finalization for a graceful shutdown
@@ -200,8 +266,7 @@ func main() {
 	defer close(stopCh)
 
 	// run the controller loop to process items
-	go serviceController.Run(stopCh)
-	go deploymentController.Run(stopCh)
+	go controller.Run(stopCh)
 
 	// use a channel to handle OS signals to terminate and gracefully shut
 	// down processing
@@ -0,0 +1,146 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// relationsFinalizer keeps a provider service around until the relation has
+// departed from all of its consumers.
+const relationsFinalizer = "tengu.io/relations"
+
+// providerKey is the queue key (format `namespace/name`) of a provider
+// service. It has its own type so the queue can hold both consumer and
+// provider keys.
+type providerKey string
+
+// departing returns true when the provider service is being deleted.
+func departing(service *corev1.Service) bool {
+	return service.DeletionTimestamp != nil
+}
+
+// hasFinalizer returns true when the service has the relations finalizer.
+func hasFinalizer(service *corev1.Service) bool {
+	return containsString(service.Finalizers, relationsFinalizer)
+}
+
+// ReconcileProvider makes sure the provider service with the given key has
+// the relations finalizer. When the service is being deleted, the relation
+// departs from all its consumers before the finalizer is released, so the
+// full service is still known while its consumers are cleaned up.
+func (t *TestHandler) ReconcileProvider(key string) error {
+	item, exists, err := t.services.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return t.reconcileUnwatchedProvider(key)
+	}
+	service := item.(*corev1.Service)
+	ctxLog := providerLog(service)
+	ctxLog.Infof("TestHandler.ReconcileProvider")
+
+	if !departing(service) {
+		if hasFinalizer(service) {
+			return nil
+		}
+		// the object from the cache is shared, so modify a copy
+		service = service.DeepCopy()
+		service.Finalizers = append(service.Finalizers, relationsFinalizer)
+		if _, err := t.clientset.CoreV1().Services(service.Namespace).Update(service); err != nil {
+			ctxLog.Errorf("Adding finalizer failed: %v", err)
+			return err
+		}
+		ctxLog.Infof("Added finalizer %s", relationsFinalizer)
+		return nil
+	}
+
+	if !hasFinalizer(service) {
+		return nil
+	}
+	return t.depart(service, key, ctxLog)
+}
+
+// reconcileUnwatchedProvider handles a service that is no longer watched. The
+// informer only watches services with the `tengu.io/provides` label, so a
+// service that loses the label looks deleted while it still has the relations
+// finalizer. Its relation departs from the consumers and the finalizer is
+// released, so deleting the service later doesn't hang.
+func (t *TestHandler) reconcileUnwatchedProvider(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	service, err := t.clientset.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Infof("TestHandler.ReconcileProvider: provider %s is gone", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ctxLog := providerLog(service)
+	if !hasFinalizer(service) {
+		return nil
+	}
+	if service.Labels["tengu.io/provides"] != "" {
+		// the watch hasn't caught up yet; the service is queued again
+		// when it is added to the cache
+		ctxLog.Infof("Provider %s isn't in the cache yet", key)
+		return nil
+	}
+	ctxLog.Infof("Service is no longer a provider")
+	return t.depart(service, key, ctxLog)
+}
+
+// depart removes the relation with the provider service from all its
+// consumers and releases the relations finalizer of the service.
+func (t *TestHandler) depart(service *corev1.Service, key string, ctxLog *log.Entry) error {
+	consumers, err := t.deployments.ByIndex(relationsIndex, key)
+	if err != nil {
+		return err
+	}
+	ctxLog.Infof("Provider is departing from %v consumers", len(consumers))
+	for _, consumer := range consumers {
+		consumerKey, err := cache.MetaNamespaceKeyFunc(consumer)
+		if err != nil {
+			return err
+		}
+		// departing providers and services that are no longer cached are
+		// left out of the desired state of the consumer, so reconciling it
+		// removes the relation
+		if err := t.Reconcile(consumerKey); err != nil {
+			ctxLog.Errorf("Departing from consumer %s failed: %v", consumerKey, err)
+			return err
+		}
+	}
+
+	service = service.DeepCopy()
+	var finalizers []string
+	for _, finalizer := range service.Finalizers {
+		if finalizer != relationsFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	service.Finalizers = finalizers
+	if _, err := t.clientset.CoreV1().Services(service.Namespace).Update(service); err != nil {
+		ctxLog.Errorf("Releasing finalizer failed: %v", err)
+		return err
+	}
+	ctxLog.Infof("Released finalizer %s", relationsFinalizer)
+	return nil
+}
+
+// providerLog returns the logger for the given provider service.
+func providerLog(service *corev1.Service) *log.Entry {
+	return log.WithFields(log.Fields{
+		// '-' prefix is here so these fields are shown first in output
+		"-name-watched":            service.Name,
+		"-type-watched":            "Service",
+		"-resourceVersion-watched": service.ResourceVersion,
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/deploymentpatch"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/orconlib"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+)
+
+const defaultDebounceWindow = 30 * time.Second
+
+// debounceWindow returns the window set by the `tengu.io/rollout-debounce`
+// annotation, or the default window when it isn't set or invalid.
+func debounceWindow(deployment *appsv1.Deployment) time.Duration {
+	annotation := deployment.Annotations["tengu.io/rollout-debounce"]
+	if annotation == "" {
+		return defaultDebounceWindow
+	}
+	window, err := time.ParseDuration(annotation)
+	if err != nil || window <= 0 {
+		log.Warnf("Invalid debounce window %q on deployment %s, using %v", annotation, deployment.Name, defaultDebounceWindow)
+		return defaultDebounceWindow
+	}
+	return window
+}
+
+// relationConfigByPolicy groups the relation data of the given services by the
+// rollout policy the consumer has chosen for each of them. Relations with a
+// default value but no available provider get their default.
+func relationConfigByPolicy(services []*corev1.Service, deployment *appsv1.Deployment) map[orconlib.RolloutPolicy]map[string]string {
+	defaultPolicy, policies := orconlib.RolloutPolicies(deployment)
+	relationConfig := make(map[orconlib.RolloutPolicy]map[string]string)
+	for _, service := range services {
+		policy, ok := policies[service.Name]
+		if !ok {
+			policy = defaultPolicy
+		}
+		if relationConfig[policy] == nil {
+			relationConfig[policy] = make(map[string]string)
+		}
+		relationConfig[policy][strings.ToUpper(service.Labels["tengu.io/provides"])] = service.Spec.ExternalName
+	}
+	// relations without an available provider fall back to their default,
+	// which has no service to pick a policy for
+	for name, value := range relationDefaults(deployment) {
+		provided := false
+		for _, config := range relationConfig {
+			if _, ok := config[name]; ok {
+				provided = true
+				break
+			}
+		}
+		if provided {
+			continue
+		}
+		if relationConfig[defaultPolicy] == nil {
+			relationConfig[defaultPolicy] = make(map[string]string)
+		}
+		relationConfig[defaultPolicy][name] = value
+	}
+	return relationConfig
+}
+
+// envDesired returns true when the variable belongs to a relation that reaches
+// the consumer through its environment.
+func envDesired(desired map[orconlib.RolloutPolicy]map[string]string, name string) bool {
+	for _, policy := range []orconlib.RolloutPolicy{orconlib.PolicyImmediate, orconlib.PolicyManual, orconlib.PolicyDebounce} {
+		if _, ok := desired[policy][name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// relationDefaults returns the default values of the relations the consumer
+// declares in its `tengu.io/consumes` annotation, keyed by variable name.
+func relationDefaults(deployment *appsv1.Deployment) map[string]string {
+	defaults := make(map[string]string)
+	requirements, err := requirement.Parse(deployment.Annotations["tengu.io/consumes"])
+	if err != nil {
+		log.Warnf("Ignoring defaults of deployment %s: invalid tengu.io/consumes: %v", deployment.Name, err)
+		return defaults
+	}
+	for _, r := range requirements {
+		if r.HasDefault {
+			defaults[r.Var()] = r.Default
+		}
+	}
+	return defaults
+}
+
+// envUpToDate returns true when all containers of the deployment already have
+// the given environment.
+func envUpToDate(deployment appsv1.Deployment, relationConfig map[string]string) bool {
+	if len(relationConfig) == 0 {
+		return true
+	}
+	patch := deploymentpatch.New(deployment)
+	patch.AppendToPodEnvironment(relationConfig)
+	return len(patch.GetPatch()) == 0
+}
+
+// debounce returns the relation data that may be rolled out for relations with
+// the debounce policy. The first change starts the debounce window of the
+// consumer and its data is rolled out once the window has passed, together
+// with all changes that arrived in the meantime.
+func (t *TestHandler) debounce(key string, origDeployment appsv1.Deployment, relationConfig map[string]string, ctxLog *log.Entry) map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if envUpToDate(origDeployment, relationConfig) {
+		delete(t.debounced, key)
+		return nil
+	}
+	now := time.Now()
+	due, scheduled := t.debounced[key]
+	if !scheduled {
+		window := debounceWindow(&origDeployment)
+		ctxLog.Infof("Scheduling rollout in %v", window)
+		t.debounced[key] = now.Add(window)
+		t.queue.AddAfter(key, window)
+		return nil
+	}
+	if now.Before(due) {
+		ctxLog.Infof("Rollout already scheduled, batching change")
+		t.queue.AddAfter(key, due.Sub(now))
+		return nil
+	}
+	ctxLog.Infof("Debounce window passed, rolling out %v relations", len(relationConfig))
+	delete(t.debounced, key)
+	return relationConfig
+}
+
+// approveManual returns the relation data that may be rolled out for relations
+// with the manual policy. Pending changes are announced in the
+// `tengu.io/pending-generation` annotation and are rolled out once the user
+// copies that value to the `tengu.io/approved-generation` annotation.
+func approveManual(origDeployment appsv1.Deployment, deployment *deploymentpatch.DeploymentPatch, relationConfig map[string]string, ctxLog *log.Entry) map[string]string {
+	if envUpToDate(origDeployment, relationConfig) {
+		return nil
+	}
+	generation := relationGeneration(relationConfig)
+	if origDeployment.Annotations["tengu.io/approved-generation"] == generation {
+		ctxLog.Infof("Relation generation %s approved", generation)
+		return relationConfig
+	}
+	ctxLog.Infof("Relation generation %s awaits approval", generation)
+	deployment.AppendToAnnotations(map[string]string{
+		"tengu.io/pending-generation": generation,
+	})
+	return nil
+}
+
+// updateRelationsConfigMap makes the ConfigMap of the deployment hold exactly
+// the given relation data and, when mount is set, makes sure the ConfigMap is
+// mounted in its containers. Only mounting the ConfigMap causes a rollout;
+// later updates of the ConfigMap are picked up by the kubelet without
+// restarting the pods.
+func (t *TestHandler) updateRelationsConfigMap(origDeployment appsv1.Deployment, deployment *deploymentpatch.DeploymentPatch, relationConfig map[string]string, mount bool, ctxLog *log.Entry) error {
+	name := orconlib.RelationsConfigMapName(origDeployment.Name)
+	configMaps := t.clientset.CoreV1().ConfigMaps(origDeployment.Namespace)
+	configMap, err := configMaps.Get(name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err) && len(relationConfig) == 0:
+		// No relations use the ConfigMap; nothing to do here.
+		return nil
+	case errors.IsNotFound(err):
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: origDeployment.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(&origDeployment, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+				},
+			},
+			Data: relationConfig,
+		}
+		if _, err = configMaps.Create(configMap); err != nil {
+			ctxLog.Errorf("Creating relations ConfigMap failed: %v", err)
+			return err
+		}
+		ctxLog.Infof("Created relations ConfigMap %s", name)
+	case err != nil:
+		ctxLog.Errorf("Getting relations ConfigMap failed: %v", err)
+		return err
+	default:
+		if !reflect.DeepEqual(configMap.Data, relationConfig) && (len(configMap.Data) > 0 || len(relationConfig) > 0) {
+			configMap.Data = relationConfig
+			if _, err = configMaps.Update(configMap); err != nil {
+				ctxLog.Errorf("Updating relations ConfigMap failed: %v", err)
+				return err
+			}
+			ctxLog.Infof("Updated relations ConfigMap %s", name)
+		}
+	}
+
+	if !mount {
+		return nil
+	}
+	deployment.AppendToPodVolumes(corev1.Volume{
+		Name: orconlib.RelationsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			},
+		},
+	})
+	deployment.AppendToPodVolumeMounts(corev1.VolumeMount{
+		Name:      orconlib.RelationsVolumeName,
+		MountPath: orconlib.RelationsMountPath,
+		ReadOnly:  true,
+	})
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Versions of the AdmissionReview API the webhook accepts.
+const (
+	admissionV1      = "admission.k8s.io/v1"
+	admissionV1beta1 = "admission.k8s.io/v1beta1"
+)
+
+// admissionReview is an AdmissionReview of either supported version. Both
+// versions have the same fields, so the request is decoded into the v1beta1
+// types and the mutate logic doesn't depend on the version; only the
+// apiVersion of the review differs.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *v1beta1.AdmissionRequest `json:"request,omitempty"`
+	Response        *admissionResponse        `json:"response,omitempty"`
+}
+
+// admissionResponse is an AdmissionResponse with the warnings that were added
+// to the API after the vendored version. API servers that don't support
+// warnings ignore them.
+type admissionResponse struct {
+	v1beta1.AdmissionResponse
+	// Warnings are shown to the client, for example by kubectl.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// admitFunc decides on an admission request.
+type admitFunc func(req *v1beta1.AdmissionRequest) *admissionResponse
+
+// decodeAdmissionReview decodes an AdmissionReview and checks that its version
+// is supported.
+func decodeAdmissionReview(body []byte) (*admissionReview, error) {
+	var review admissionReview
+	if err := json.Unmarshal(body, &review); err != nil {
+		return nil, err
+	}
+	if review.Kind != "AdmissionReview" {
+		return nil, fmt.Errorf("unexpected kind %q, expect AdmissionReview", review.Kind)
+	}
+	switch review.APIVersion {
+	case admissionV1, admissionV1beta1:
+	default:
+		return nil, fmt.Errorf("unsupported apiVersion %q, expect %s or %s", review.APIVersion, admissionV1, admissionV1beta1)
+	}
+	if review.Request == nil {
+		return nil, fmt.Errorf("AdmissionReview has no request")
+	}
+	return &review, nil
+}
+
+// reply returns the review that answers this review with the given response,
+// in the version of the request.
+func (review *admissionReview) reply(response *admissionResponse) *admissionReview {
+	// the API server matches the response to the request by its UID
+	response.UID = review.Request.UID
+	return &admissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: response,
+	}
+}
+
+// serveAdmission decodes the AdmissionReview in the body of the request, lets
+// admit decide on it and writes the answer.
+func serveAdmission(w http.ResponseWriter, r *http.Request, admit admitFunc) {
+	var body []byte
+	if r.Body != nil {
+		if data, err := ioutil.ReadAll(r.Body); err == nil {
+			body = data
+		}
+	}
+	if len(body) == 0 {
+		log.Error("empty body")
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	//verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		log.Errorf("Content-Type=%s, expect application/json", contentType)
+		http.Error(w, "invalid Content-Type, expect application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// answer in the version of the request, so the webhook can be
+	// registered for both admission.k8s.io/v1 and v1beta1
+	ar, err := decodeAdmissionReview(body)
+	if err != nil {
+		log.Errorf("Can't decode body: %v", err)
+		http.Error(w, fmt.Sprintf("could not decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Infof("AdmissionReview %s", ar.APIVersion)
+	admissionReview := ar.reply(admit(ar.Request))
+
+	resp, err := json.Marshal(admissionReview)
+	if err != nil {
+		log.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Ready to write response ...")
+	if _, err := w.Write(resp); err != nil {
+		log.Errorf("Can't write response: %v", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// certReloader serves the keypair of the webhook and reloads it when the
+// certificate or key file changes, so rotated certificates are used without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	// mu guards the fields below.
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	certData []byte
+	keyData  []byte
+	reloads  int
+	failures int
+}
+
+// newCertReloader loads the keypair from the given files. Failing to load the
+// initial keypair is an error, so the webhook never serves without a
+// certificate.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	certData, keyData, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certData, keyData); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// read returns the contents of the certificate and key files.
+func (r *certReloader) read() ([]byte, []byte, error) {
+	certData, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certData, keyData, nil
+}
+
+// load parses the keypair and makes it the one that is served.
+func (r *certReloader) load(certData, keyData []byte) error {
+	pair, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	pair.Leaf = leaf
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &pair
+	r.notAfter = leaf.NotAfter
+	r.certData = certData
+	r.keyData = keyData
+	log.Infof("Loaded certificate for %v, valid until %v", leaf.DNSNames, leaf.NotAfter)
+	return nil
+}
+
+// GetCertificate returns the current keypair; it is used as the
+// GetCertificate callback of the TLS configuration.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// update loads the keypair when it differs from the one that is served, and
+// counts the outcome.
+func (r *certReloader) update(certData, keyData []byte) error {
+	r.mu.RLock()
+	changed := !bytes.Equal(certData, r.certData) || !bytes.Equal(keyData, r.keyData)
+	initial := r.cert == nil
+	r.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	err := r.load(certData, keyData)
+	if initial {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failures++
+		return err
+	}
+	r.reloads++
+	return nil
+}
+
+// watch checks the certificate and key files for changes every period until
+// stopCh is closed. The files are mounted from a Secret, which the kubelet
+// updates in place. When loading a changed keypair fails, for example because
+// only one of the files was updated yet, the current keypair stays in use and
+// loading is retried on the next check.
+func (r *certReloader) watch(period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		certData, keyData, err := r.read()
+		if err == nil {
+			err = r.update(certData, keyData)
+		}
+		if err != nil {
+			log.Errorf("Failed to reload key pair, keeping the current one: %v", err)
+		}
+	}
+}
+
+// serveMetrics writes the certificate metrics in the Prometheus text format.
+func (r *certReloader) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP tengu_webhook_certificate_expiry_timestamp_seconds Time at which the serving certificate expires.\n")
+	fmt.Fprintf(w, "# TYPE tengu_webhook_certificate_expiry_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "tengu_webhook_certificate_expiry_timestamp_seconds %d\n", r.notAfter.Unix())
+	fmt.Fprintf(w, "# HELP tengu_webhook_certificate_reloads_total Number of times a changed keypair was loaded.\n")
+	fmt.Fprintf(w, "# TYPE tengu_webhook_certificate_reloads_total counter\n")
+	fmt.Fprintf(w, "tengu_webhook_certificate_reloads_total %d\n", r.reloads)
+	fmt.Fprintf(w, "# HELP tengu_webhook_certificate_reload_errors_total Number of times loading a changed keypair failed.\n")
+	fmt.Fprintf(w, "# TYPE tengu_webhook_certificate_reload_errors_total counter\n")
+	fmt.Fprintf(w, "tengu_webhook_certificate_reload_errors_total %d\n", r.failures)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfig reads, parses and validates the configuration file. It also
+// returns the contents of the file, so later changes can be detected.
+func loadConfig(configFile string) (*Config, []byte, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Infof("New configuration: sha256sum %x", sha256.Sum256(data))
+
+	var cfg Config
+
+	// the containers are decoded like Kubernetes objects, with their JSON
+	// field names
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
+	applyDefaultsWorkaround(cfg.InitContainers)
+	applyDefaultsWorkaround(cfg.Sidecars)
+
+	return &cfg, data, nil
+}
+
+// validate checks that the containers of the configuration can be injected,
+// and parses the object selector.
+func (cfg *Config) validate() error {
+	if len(cfg.InitContainers) == 0 {
+		return fmt.Errorf("no initContainers configured")
+	}
+	for kind, containers := range map[string][]corev1.Container{
+		"initContainers": cfg.InitContainers,
+		"sidecars":       cfg.Sidecars,
+	} {
+		names := make(map[string]bool)
+		for i, container := range containers {
+			if container.Name == "" || container.Image == "" {
+				return fmt.Errorf("%s[%d]: name and image are required", kind, i)
+			}
+			if names[container.Name] {
+				return fmt.Errorf("%s[%d]: duplicate name %q", kind, i, container.Name)
+			}
+			names[container.Name] = true
+			if _, err := template.New("image").Parse(container.Image); err != nil {
+				return fmt.Errorf("%s[%d]: invalid image template: %v", kind, i, err)
+			}
+			for _, env := range container.Env {
+				if _, err := template.New("env").Parse(env.Value); err != nil {
+					return fmt.Errorf("%s[%d]: invalid template in env %s: %v", kind, i, env.Name, err)
+				}
+			}
+		}
+	}
+	if cfg.ObjectSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(cfg.ObjectSelector)
+		if err != nil {
+			return fmt.Errorf("objectSelector: %v", err)
+		}
+		cfg.selector = selector
+	}
+	for name, profile := range cfg.Profiles {
+		if name == "" {
+			return fmt.Errorf("profiles: empty profile name")
+		}
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("profiles[%s]: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// currentConfig returns the configuration in use.
+func (whsvr *WebhookServer) currentConfig() *Config {
+	return whsvr.config.Load().(*Config)
+}
+
+// watchConfig checks the configuration file for changes every period until
+// stopCh is closed. The file is mounted from a ConfigMap, which the kubelet
+// updates in place. A changed file is loaded and swapped in atomically; an
+// invalid one is rejected and the last good configuration stays in use.
+func (whsvr *WebhookServer) watchConfig(configFile string, data []byte, period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		current, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			log.Errorf("Failed to read configuration: %v", err)
+			continue
+		}
+		if bytes.Equal(current, data) {
+			continue
+		}
+		cfg, loaded, err := loadConfig(configFile)
+		if err != nil {
+			log.Errorf("Rejecting new configuration, keeping the last good one: %v", err)
+			// don't retry the same invalid configuration on every tick
+			data = current
+			continue
+		}
+		whsvr.config.Store(cfg)
+		data = loaded
+		log.Infof("Reloaded configuration: %d init containers, %d sidecars", len(cfg.InitContainers), len(cfg.Sidecars))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newNamespaceInformer returns an informer of all namespaces, so the webhook
+// reads their validation mode without asking the API server on every request.
+func newNamespaceInformer(client kubernetes.Interface) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Namespaces().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Namespaces().Watch(options)
+			},
+		},
+		&corev1.Namespace{},
+		0, // the cache is only read, so there is nothing to resync
+		cache.Indexers{},
+	)
+}
+
+// newConfigMapInformer returns an informer of the ConfigMaps with the given
+// name in all namespaces, like the ConfigMaps that override the injected
+// containers of their namespace.
+func newConfigMapInformer(client kubernetes.Interface, name string) cache.SharedIndexInformer {
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return client.CoreV1().ConfigMaps(metav1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return client.CoreV1().ConfigMaps(metav1.NamespaceAll).Watch(options)
+			},
+		},
+		&corev1.ConfigMap{},
+		0, // the cache is only read, so there is nothing to resync
+		cache.Indexers{},
+	)
+}
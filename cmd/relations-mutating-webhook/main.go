@@ -5,12 +5,16 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"k8s.io/client-go/tools/cache"
 )
 
 func main() {
@@ -21,31 +25,105 @@ func main() {
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
 	flag.StringVar(&parameters.initcontainerCfgFile, "tenguCfgFile", "/etc/webhook/config/tenguconfig.yaml", "File containing the mutation configuration.")
+	flag.DurationVar(&parameters.certReloadPeriod, "certReloadPeriod", time.Minute, "How often the key pair is checked for changes.")
+	flag.DurationVar(&parameters.configReloadPeriod, "configReloadPeriod", 10*time.Second, "How often the mutation configuration is checked for changes.")
+	flag.BoolVar(&parameters.selfManagedCerts, "selfManagedCerts", false, "Generate and rotate the certificates, and patch the caBundle of the webhook configuration.")
+	flag.StringVar(&parameters.certSecret, "certSecret", "relations-mutating-webhook-certs", "Secret holding the self-managed certificates.")
+	flag.StringVar(&parameters.serviceName, "serviceName", "relations-mutating-webhook", "Service of the webhook, used in the self-managed certificate.")
+	flag.StringVar(&parameters.namespace, "namespace", "", "Namespace of the service and the certificate Secret; defaults to the namespace of the pod.")
+	flag.StringVar(&parameters.webhookConfigName, "webhookConfigName", "relations-mutating-webhook", "MutatingWebhookConfiguration whose caBundle is patched with the self-managed CA.")
+	flag.StringVar(&parameters.validatingConfigName, "validatingWebhookConfigName", "relations-validating-webhook", "ValidatingWebhookConfiguration whose caBundle is patched with the self-managed CA.")
+	flag.StringVar(&parameters.validationMode, "validationMode", validationWarn, "Validation mode of namespaces without the tengu.io/validation label: enforce or warn.")
+	flag.StringVar(&parameters.namespaceConfigMap, "namespaceConfigMap", "tengu-injector", "ConfigMap that overrides the injected containers in its namespace; empty disables the overrides.")
+	flag.StringVar(&parameters.ignoredNamespaces, "ignoredNamespaces", strings.Join(defaultIgnoredNamespaces, ","), "Comma-separated namespaces the webhook leaves alone, next to the ignoredNamespaces of the configuration.")
+	flag.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Kubeconfig used outside of a cluster; defaults to ~/.kube/config.")
 	flag.Parse()
 
-	initcontainerConfig, err := loadConfig(parameters.initcontainerCfgFile)
+	if !validValidationMode(parameters.validationMode) {
+		glog.Fatalf("Invalid validation mode %q, expect %q or %q", parameters.validationMode, validationEnforce, validationWarn)
+	}
+
+	clientset, err := getKubernetesClient(parameters.kubeconfig)
+	if err != nil {
+		glog.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	initcontainerConfig, configData, err := loadConfig(parameters.initcontainerCfgFile)
 	if err != nil {
-		glog.Errorf("Failed to load configuration: %v", err)
+		glog.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	glog.Infof("Number of Init Containers: %d", len(initcontainerConfig.InitContainers))
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
-	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+	// stop the reload loops on shutdown
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	var certs *certReloader
+	if parameters.selfManagedCerts {
+		manager := &certManager{
+			clientset:            clientset,
+			namespace:            parameters.namespace,
+			secretName:           parameters.certSecret,
+			serviceName:          parameters.serviceName,
+			webhookConfigName:    parameters.webhookConfigName,
+			validatingConfigName: parameters.validatingConfigName,
+			certs:                &certReloader{},
+		}
+		if manager.namespace == "" {
+			manager.namespace = podNamespace()
+		}
+		if err := manager.sync(); err != nil {
+			glog.Fatalf("Failed to set up self-managed certificates: %v", err)
+		}
+		certs = manager.certs
+		// rotate the certificates and pick up the ones rotated by other
+		// replicas
+		go manager.run(parameters.certReloadPeriod, stopCh)
+	} else {
+		certs, err = newCertReloader(parameters.certFile, parameters.keyFile)
+		if err != nil {
+			glog.Fatalf("Failed to load key pair: %v", err)
+		}
+		// reload the keypair when its Secret changes
+		go certs.watch(parameters.certReloadPeriod, stopCh)
 	}
 
 	whsvr := &WebhookServer{
-		initcontainerConfig: initcontainerConfig,
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate},
 		},
+		validationMode:     parameters.validationMode,
+		namespaceConfigMap: parameters.namespaceConfigMap,
+		ignoredNamespaces:  splitList(parameters.ignoredNamespaces),
+		clientset:          clientset,
 	}
+	whsvr.config.Store(initcontainerConfig)
+
+	// cache the namespace settings that are read during admission
+	namespaceInformer := newNamespaceInformer(clientset)
+	go namespaceInformer.Run(stopCh)
+	whsvr.namespaces = namespaceInformer.GetIndexer()
+	synced := []cache.InformerSynced{namespaceInformer.HasSynced}
+	if parameters.namespaceConfigMap != "" {
+		configMapInformer := newConfigMapInformer(clientset, parameters.namespaceConfigMap)
+		go configMapInformer.Run(stopCh)
+		whsvr.namespaceConfigMaps = configMapInformer.GetIndexer()
+		synced = append(synced, configMapInformer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		glog.Fatalf("Failed to sync the namespace caches")
+	}
+
+	// reload the configuration when its ConfigMap changes
+	go whsvr.watchConfig(parameters.initcontainerCfgFile, configData, parameters.configReloadPeriod, stopCh)
 
 	// define http server and server handler
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", whsvr.serve)
+	mux.HandleFunc("/mutate", whsvr.serveMutate)
+	mux.HandleFunc("/validate", whsvr.serveValidate)
+	mux.HandleFunc("/metrics", certs.serveMetrics)
 	whsvr.server.Handler = mux
 
 	// start webhook server in new routine
@@ -63,3 +141,25 @@ func main() {
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
 	whsvr.server.Shutdown(context.Background())
 }
+
+// podNamespace returns the namespace the webhook runs in, read from its
+// service account.
+func podNamespace() string {
+	data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		glog.Warningf("Failed to read the pod namespace, using \"default\": %v", err)
+		return "default"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// splitList splits a comma-separated flag value, ignoring empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/deploymentpatch"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/orconlib"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// relationAnnotation returns true for the annotations that declare relations
+// or record their injection.
+func relationAnnotation(key string) bool {
+	return strings.HasPrefix(key, "tengu.io/") || strings.HasPrefix(key, "injector.tengu.io/")
+}
+
+// ownerResource returns the resource of the given owner kind, looked up through
+// the discovery API. The resource of a kind doesn't change, so it is only looked
+// up once.
+func (whsvr *WebhookServer) ownerResource(owner *metav1.OwnerReference) (string, error) {
+	key := owner.APIVersion + "/" + owner.Kind
+	if resource, ok := whsvr.ownerResources.Load(key); ok {
+		return resource.(string), nil
+	}
+	resources, err := whsvr.clientset.Discovery().ServerResourcesForGroupVersion(owner.APIVersion)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range resources.APIResources {
+		// skip subresources like `jobs/status`
+		if r.Kind == owner.Kind && !strings.Contains(r.Name, "/") {
+			whsvr.ownerResources.Store(key, r.Name)
+			return r.Name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown owner kind %s in %s", owner.Kind, owner.APIVersion)
+}
+
+// ownerAnnotations returns the annotations of the controller of the pod, for
+// example the Job or the Workflow that created it. Owners of any kind are
+// looked up through the discovery API. The pods of ReplicaSets aren't looked
+// up: they belong to Deployments, whose pod template is injected instead.
+func (whsvr *WebhookServer) ownerAnnotations(pod *corev1.Pod) (map[string]string, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || (owner.APIVersion == "apps/v1" && owner.Kind == "ReplicaSet") {
+		return nil, nil
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	resource, err := whsvr.ownerResource(owner)
+	if err != nil {
+		return nil, err
+	}
+	path := "/apis/" + gv.Group + "/" + gv.Version
+	if gv.Group == "" {
+		path = "/api/" + gv.Version
+	}
+	path += "/namespaces/" + pod.Namespace + "/" + resource + "/" + owner.Name
+
+	data, err := whsvr.clientset.CoreV1().RESTClient().Get().AbsPath(path).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	var object struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	return object.Metadata.Annotations, nil
+}
+
+// podAnnotations returns the relation declaration of the pod. A pod without
+// its own declaration inherits the one of its controller, and reports so.
+func (whsvr *WebhookServer) podAnnotations(pod *corev1.Pod) (map[string]string, bool) {
+	if pod.Annotations["tengu.io/consumes"] != "" {
+		return pod.Annotations, false
+	}
+	owned, err := whsvr.ownerAnnotations(pod)
+	if err != nil {
+		log.Warnf("Failed to look up the owner of pod %s/%s: %v", pod.Namespace, podName(pod), err)
+		return pod.Annotations, false
+	}
+	if owned["tengu.io/consumes"] == "" {
+		return pod.Annotations, false
+	}
+	annotations := make(map[string]string)
+	for key, value := range pod.Annotations {
+		annotations[key] = value
+	}
+	for key, value := range owned {
+		if relationAnnotation(key) {
+			annotations[key] = value
+		}
+	}
+	return annotations, true
+}
+
+// podName returns the name of the pod, or its name prefix when the API server
+// hasn't generated the name yet.
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+// missingRelations returns the names of the required relations in the
+// declaration that have no relation data.
+func missingRelations(annotations map[string]string, relations map[string]string) []string {
+	requirements, err := requirement.Parse(annotations["tengu.io/consumes"])
+	if err != nil {
+		// the caller rejects the consumer
+		return nil
+	}
+	var missing []string
+	for _, r := range requirements {
+		if _, ok := relations[r.Var()]; !ok && r.Blocking() {
+			missing = append(missing, r.Name)
+		}
+	}
+	return missing
+}
+
+// mutatePod injects the init container in a pod that declares relations, or
+// whose controller does. The environment of a pod can't change after it is
+// created, so the relation data that is available at admission is injected
+// right away, and a pod whose required relations aren't available yet is
+// rejected: its init container would wait for them forever. Controllers like
+// Jobs retry creating their pods. Pods owned by a workload whose pod template
+// was injected already, like the pods of a Deployment, are left alone.
+func (whsvr *WebhookServer) mutatePod(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		log.Errorf("Could not unmarshal raw object: %v", err)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	log.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Namespace, podName(&pod), req.UID, req.Operation, req.UserInfo)
+
+	annotations, inherited := whsvr.podAnnotations(&pod)
+	if inherited && annotations["injector.tengu.io/status"] == "injected" {
+		log.Infof("Not mutating pod %s/%s: the pod template of its owner is injected", pod.Namespace, podName(&pod))
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// the pod is handled as a consumer whose pod template is the pod itself
+	consumer := &appsv1.Deployment{
+		ObjectMeta: *pod.ObjectMeta.DeepCopy(),
+	}
+	consumer.Name = podName(&pod)
+	consumer.Annotations = annotations
+	consumer.Spec.Template = corev1.PodTemplateSpec{
+		ObjectMeta: pod.ObjectMeta,
+		Spec:       pod.Spec,
+	}
+
+	if !containsString(mutationRequired(whsvr.ignoredNamespaceList(), whsvr.currentConfig().selector, &consumer.ObjectMeta), "consumes") {
+		log.Infof("Not mutating pod %s/%s", pod.Namespace, podName(&pod))
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	if orconlib.LiveRelations(annotations) {
+		return invalid(consumer, fmt.Errorf("tengu.io/init-mode volume and api and tengu.io/sidecar aren't supported for pods: the relations controller only keeps the relations of Deployments up to date"))
+	}
+	relations := whsvr.availableRelations(pod.Namespace, annotations, nil)
+	if missing := missingRelations(annotations, relations); len(missing) > 0 {
+		return invalid(consumer, fmt.Errorf("required relations %s have no provider yet; the environment of a pod can't change after it is created, so it would never start", strings.Join(missing, ", ")))
+	}
+	return whsvr.injectConsumer(consumer, deploymentpatch.NewForPod(pod), relations)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Keys of the namespace ConfigMap.
+const (
+	// namespaceProfileKey selects the profile of the consumers in the
+	// namespace that don't select one themselves.
+	namespaceProfileKey = "profile"
+	// namespaceOverridesKey holds a Profile that is applied after the
+	// selected one.
+	namespaceOverridesKey = "overrides.yaml"
+)
+
+// Profile overrides fields of the injected containers.
+type Profile struct {
+	InitContainers ContainerOverride `json:"initContainers"`
+	Sidecars       ContainerOverride `json:"sidecars"`
+}
+
+// ContainerOverride holds the fields that replace those of the injected
+// containers. Fields that aren't set are left alone.
+type ContainerOverride struct {
+	Image           string                       `json:"image,omitempty"`
+	ImagePullPolicy corev1.PullPolicy            `json:"imagePullPolicy,omitempty"`
+	Resources       *corev1.ResourceRequirements `json:"resources,omitempty"`
+	SecurityContext *corev1.SecurityContext      `json:"securityContext,omitempty"`
+}
+
+// templateData is what the image and the environment of injected containers
+// can refer to, for example `registry.local/{{ .Namespace }}/init:v1`.
+type templateData struct {
+	Namespace   string
+	Name        string
+	Annotations map[string]string
+}
+
+// validate checks that the templates in the profile parse.
+func (p Profile) validate() error {
+	for kind, override := range map[string]ContainerOverride{
+		"initContainers": p.InitContainers,
+		"sidecars":       p.Sidecars,
+	} {
+		if _, err := template.New("image").Parse(override.Image); err != nil {
+			return fmt.Errorf("%s: invalid image template: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+// apply overrides the fields of the container that are set in the override.
+func (o ContainerOverride) apply(container *corev1.Container) {
+	if o.Image != "" {
+		container.Image = o.Image
+	}
+	if o.ImagePullPolicy != "" {
+		container.ImagePullPolicy = o.ImagePullPolicy
+	}
+	if o.Resources != nil {
+		container.Resources = *o.Resources.DeepCopy()
+	}
+	if o.SecurityContext != nil {
+		container.SecurityContext = o.SecurityContext.DeepCopy()
+	}
+}
+
+// render executes the template in s.
+func render(s string, data templateData) (string, error) {
+	t, err := template.New("").Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// renderContainer executes the templates in the image and the environment of
+// the container.
+func renderContainer(container *corev1.Container, data templateData) error {
+	var err error
+	if container.Image, err = render(container.Image, data); err != nil {
+		return fmt.Errorf("container %s: image: %v", container.Name, err)
+	}
+	for i := range container.Env {
+		if container.Env[i].Value, err = render(container.Env[i].Value, data); err != nil {
+			return fmt.Errorf("container %s: env %s: %v", container.Name, container.Env[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// namespaceConfig returns the profile the namespace selects and its
+// overrides, from the namespace ConfigMap. A namespace without the ConfigMap
+// has neither.
+func (whsvr *WebhookServer) namespaceConfig(namespace string) (string, *Profile, error) {
+	if whsvr.namespaceConfigMap == "" {
+		return "", nil, nil
+	}
+	item, exists, err := whsvr.namespaceConfigMaps.GetByKey(namespace + "/" + whsvr.namespaceConfigMap)
+	if err != nil {
+		log.Warnf("Failed to get ConfigMap %s/%s, ignoring the overrides of the namespace: %v", namespace, whsvr.namespaceConfigMap, err)
+		return "", nil, nil
+	}
+	if !exists {
+		return "", nil, nil
+	}
+	configMap := item.(*corev1.ConfigMap)
+	data, ok := configMap.Data[namespaceOverridesKey]
+	if !ok {
+		return configMap.Data[namespaceProfileKey], nil, nil
+	}
+	var overrides Profile
+	if err := yaml.Unmarshal([]byte(data), &overrides); err != nil {
+		return "", nil, fmt.Errorf("invalid %s in ConfigMap %s: %v", namespaceOverridesKey, whsvr.namespaceConfigMap, err)
+	}
+	if err := overrides.validate(); err != nil {
+		return "", nil, fmt.Errorf("invalid %s in ConfigMap %s: %v", namespaceOverridesKey, whsvr.namespaceConfigMap, err)
+	}
+	return configMap.Data[namespaceProfileKey], &overrides, nil
+}
+
+// consumerConfig returns the containers to inject in the consumer. They are
+// the containers of the webhook configuration, changed by the profile the
+// consumer selects with the `injector.tengu.io/profile` annotation or else by
+// the profile its namespace selects, then by the overrides of its namespace.
+// Finally the templates in their images and environments are executed.
+func (whsvr *WebhookServer) consumerConfig(consumer *appsv1.Deployment) (*Config, error) {
+	config := whsvr.currentConfig()
+	namespaceProfile, overrides, err := whsvr.namespaceConfig(consumer.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []Profile
+	name := consumer.Annotations["injector.tengu.io/profile"]
+	if name == "" {
+		name = namespaceProfile
+	}
+	if name != "" {
+		profile, ok := config.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown injection profile %q", name)
+		}
+		profiles = append(profiles, profile)
+	}
+	if overrides != nil {
+		profiles = append(profiles, *overrides)
+	}
+
+	data := templateData{
+		Namespace:   consumer.Namespace,
+		Name:        consumer.Name,
+		Annotations: consumer.Annotations,
+	}
+	// the configuration is shared by all requests, so modify copies
+	result := &Config{}
+	for _, c := range config.InitContainers {
+		container := *c.DeepCopy()
+		for _, profile := range profiles {
+			profile.InitContainers.apply(&container)
+		}
+		if err := renderContainer(&container, data); err != nil {
+			return nil, err
+		}
+		result.InitContainers = append(result.InitContainers, container)
+	}
+	for _, c := range config.Sidecars {
+		container := *c.DeepCopy()
+		for _, profile := range profiles {
+			profile.Sidecars.apply(&container)
+		}
+		if err := renderContainer(&container, data); err != nil {
+			return nil, err
+		}
+		result.Sidecars = append(result.Sidecars, container)
+	}
+	return result, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// availableRelations returns the relation data of the providers in the
+// `tengu.io/relations` annotation that exist at admission, in the form the
+// relations controller injects it, plus the defaults of the relations without
+// a provider. Failing to look up a provider isn't an error; its relation
+// arrives later. The relations of the providers that held returns true for are
+// left out, together with their defaults; held is called with an empty name for
+// the defaults of relations without a provider. A nil held holds back nothing.
+func (whsvr *WebhookServer) availableRelations(namespace string, annotations map[string]string, held func(provider string) bool) map[string]string {
+	relations := make(map[string]string)
+	heldVars := make(map[string]bool)
+	if names := annotations["tengu.io/relations"]; names != "" {
+		for _, name := range strings.Split(names, ",") {
+			service, err := whsvr.clientset.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				if !errors.IsNotFound(err) {
+					log.Warnf("Failed to look up provider Service %s/%s: %v", namespace, name, err)
+				}
+				continue
+			}
+			provides := service.Labels["tengu.io/provides"]
+			if provides == "" || service.DeletionTimestamp != nil {
+				continue
+			}
+			if held != nil && held(name) {
+				heldVars[strings.ToUpper(provides)] = true
+				continue
+			}
+			relations[strings.ToUpper(provides)] = service.Spec.ExternalName
+		}
+	}
+
+	requirements, err := requirement.Parse(annotations["tengu.io/consumes"])
+	if err != nil {
+		// the caller rejects the consumer
+		return relations
+	}
+	if held != nil && held("") {
+		return relations
+	}
+	for _, r := range requirements {
+		if _, ok := relations[r.Var()]; !ok && !heldVars[r.Var()] && r.HasDefault {
+			relations[r.Var()] = r.Default
+		}
+	}
+	return relations
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Keys of the certificate Secret.
+const (
+	secretCACert   = "ca.crt"
+	secretCAKey    = "ca.key"
+	secretCABundle = "ca-bundle.crt"
+	secretCert     = "tls.crt"
+	secretKey      = "tls.key"
+)
+
+const (
+	caValidity      = 10 * 365 * 24 * time.Hour
+	caRenewBefore   = 365 * 24 * time.Hour
+	certValidity    = 365 * 24 * time.Hour
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// certManager lets the webhook manage its own certificates, instead of
+// depending on certificates signed by the cluster. It generates a CA and a
+// serving certificate, stores them in a Secret so all replicas share them,
+// rotates them before they expire, and keeps the caBundle of the
+// MutatingWebhookConfiguration up to date.
+type certManager struct {
+	clientset         kubernetes.Interface
+	namespace         string
+	secretName        string
+	serviceName       string
+	webhookConfigName string
+	// validatingConfigName is the ValidatingWebhookConfiguration whose
+	// caBundle is managed as well.
+	validatingConfigName string
+	certs                *certReloader
+}
+
+// dnsNames returns the names the API server uses to reach the webhook service.
+func (m *certManager) dnsNames() []string {
+	return []string{
+		m.serviceName,
+		m.serviceName + "." + m.namespace,
+		m.serviceName + "." + m.namespace + ".svc",
+	}
+}
+
+// run syncs the certificates every period until stopCh is closed.
+func (m *certManager) run(period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if err := m.sync(); err != nil {
+			log.Errorf("Failed to sync certificates, keeping the current ones: %v", err)
+		}
+	}
+}
+
+// sync makes sure the Secret holds a valid CA and serving certificate, serves
+// the certificate from the Secret and patches the caBundle of the webhook
+// configuration. Certificates rotated by another replica are picked up as
+// well.
+func (m *certManager) sync() error {
+	secrets := m.clientset.CoreV1().Secrets(m.namespace)
+	secret, err := secrets.Get(m.secretName, metav1.GetOptions{})
+	exists := true
+	if errors.IsNotFound(err) {
+		exists = false
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.secretName,
+				Namespace: m.namespace,
+			},
+		}
+	} else if err != nil {
+		return err
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	changed, err := m.ensureCerts(secret.Data)
+	if err != nil {
+		return err
+	}
+	switch {
+	case changed && exists:
+		// a conflict means another replica rotated the certificates; the
+		// next sync picks those up
+		if secret, err = secrets.Update(secret); err != nil {
+			return err
+		}
+		log.Infof("Rotated certificates in Secret %s/%s", m.namespace, m.secretName)
+	case changed:
+		if secret, err = secrets.Create(secret); err != nil {
+			return err
+		}
+		log.Infof("Stored certificates in Secret %s/%s", m.namespace, m.secretName)
+	}
+
+	if err := m.certs.update(secret.Data[secretCert], secret.Data[secretKey]); err != nil {
+		return err
+	}
+	if err := m.patchCABundle("mutatingwebhookconfigurations", m.webhookConfigName, secret.Data[secretCABundle]); err != nil {
+		return err
+	}
+	return m.patchCABundle("validatingwebhookconfigurations", m.validatingConfigName, secret.Data[secretCABundle])
+}
+
+// ensureCerts generates the CA and serving certificate in the Secret data when
+// they are missing, invalid or about to expire, and returns whether the data
+// changed. A new CA is added to the CA bundle next to the old one, so the API
+// server keeps trusting the certificate that is still served by replicas that
+// haven't picked up the new one.
+func (m *certManager) ensureCerts(data map[string][]byte) (bool, error) {
+	now := time.Now()
+	changed := false
+
+	ca, caKey, err := parseKeyPair(data[secretCACert], data[secretCAKey])
+	if err != nil || now.Add(caRenewBefore).After(ca.NotAfter) {
+		log.Infof("Generating a new CA")
+		caCertPEM, caKeyPEM, err := generateCert(nil, nil, "relations-mutating-webhook-ca", nil, caValidity)
+		if err != nil {
+			return false, err
+		}
+		bundle := caCertPEM
+		if old, err := parseCert(data[secretCACert]); err == nil && now.Before(old.NotAfter) {
+			bundle = append(append([]byte{}, caCertPEM...), data[secretCACert]...)
+		}
+		data[secretCACert], data[secretCAKey], data[secretCABundle] = caCertPEM, caKeyPEM, bundle
+		if ca, caKey, err = parseKeyPair(caCertPEM, caKeyPEM); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if len(data[secretCABundle]) == 0 {
+		data[secretCABundle] = data[secretCACert]
+		changed = true
+	}
+
+	cert, _, err := parseKeyPair(data[secretCert], data[secretKey])
+	if err != nil || now.Add(certRenewBefore).After(cert.NotAfter) || cert.CheckSignatureFrom(ca) != nil || cert.VerifyHostname(m.dnsNames()[2]) != nil {
+		log.Infof("Generating a new serving certificate for %v", m.dnsNames())
+		certPEM, keyPEM, err := generateCert(ca, caKey, m.dnsNames()[2], m.dnsNames(), certValidity)
+		if err != nil {
+			return false, err
+		}
+		data[secretCert], data[secretKey] = certPEM, keyPEM
+		changed = true
+	}
+	return changed, nil
+}
+
+// webhookConfigPath returns the API path of the webhook configuration of the
+// given resource. It uses admissionregistration.k8s.io/v1 when the cluster
+// serves it, since newer clusters no longer serve v1beta1.
+func (m *certManager) webhookConfigPath(resource, name string) string {
+	version := "v1beta1"
+	if _, err := m.clientset.Discovery().ServerResourcesForGroupVersion("admissionregistration.k8s.io/v1"); err == nil {
+		version = "v1"
+	}
+	return "/apis/admissionregistration.k8s.io/" + version + "/" + resource + "/" + name
+}
+
+// patchCABundle sets the CA bundle of all webhooks in the webhook
+// configuration. The vendored client only knows v1beta1, so the configuration
+// is patched through the REST client to support both versions.
+func (m *certManager) patchCABundle(resource, name string, bundle []byte) error {
+	client := m.clientset.AdmissionregistrationV1beta1().RESTClient()
+	path := m.webhookConfigPath(resource, name)
+	data, err := client.Get().AbsPath(path).DoRaw()
+	if errors.IsNotFound(err) {
+		log.Warnf("Webhook configuration %s/%s doesn't exist (yet)", resource, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// both versions and both kinds of configuration have the same fields
+	var config admissionregistrationv1beta1.MutatingWebhookConfiguration
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	// the patch fails when the configuration changed in the meantime, so
+	// the indexes are never applied to the wrong webhooks
+	patch := []map[string]interface{}{{
+		"op":    "test",
+		"path":  "/metadata/resourceVersion",
+		"value": config.ResourceVersion,
+	}}
+	for i, webhook := range config.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, bundle) {
+			patch = append(patch, map[string]interface{}{
+				"op":    "add",
+				"path":  fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i),
+				"value": bundle,
+			})
+		}
+	}
+	if len(patch) == 1 {
+		return nil
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if err := client.Patch(types.JSONPatchType).AbsPath(path).Body(patchBytes).Do().Error(); err != nil {
+		return err
+	}
+	log.Infof("Patched caBundle of %s/%s", resource, name)
+	return nil
+}
+
+// parseCert parses a PEM encoded certificate.
+func parseCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parseKeyPair parses a PEM encoded certificate and EC private key.
+func parseKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// generateCert generates a PEM encoded certificate and key. Without a parent,
+// the certificate is a self-signed CA.
+func generateCert(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, commonName string, dnsNames []string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		// allow for clock skew between the webhook and the API server
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := parent, parentKey
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = nil
+		signer, signerKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Validation modes. The mode of a namespace is set with the
+// `tengu.io/validation` label; namespaces without it use the default mode of
+// the webhook.
+const (
+	// validationEnforce rejects workloads with an invalid relation
+	// declaration.
+	validationEnforce = "enforce"
+	// validationWarn admits them with admission warnings.
+	validationWarn = "warn"
+)
+
+// validValidationMode returns true for the known validation modes.
+func validValidationMode(mode string) bool {
+	return mode == validationEnforce || mode == validationWarn
+}
+
+// relationProblems returns what is wrong with the relation declaration in the
+// given annotations of a consumer in the namespace: invalid or duplicated
+// names, provider Services that don't exist, required interfaces that no
+// provider offers and interfaces that more than one provider offers. Failing to look up a Service isn't a
+// problem of the declaration, so it is only logged.
+func relationProblems(client kubernetes.Interface, namespace string, annotations map[string]string) []string {
+	var problems []string
+
+	requirements, err := requirement.Parse(annotations["tengu.io/consumes"])
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("invalid tengu.io/consumes: %v", err))
+	}
+
+	var relations []string
+	if annotation := annotations["tengu.io/relations"]; annotation != "" {
+		relations = strings.Split(annotation, ",")
+	}
+	// optional and defaulted relations may leave out their provider
+	blocking := 0
+	for _, r := range requirements {
+		if r.Blocking() {
+			blocking++
+		}
+	}
+	if (len(relations) < blocking || len(relations) > len(requirements)) && err == nil {
+		problems = append(problems, fmt.Sprintf("tengu.io/relations lists %d providers but tengu.io/consumes %d interfaces, of which %d are required", len(relations), len(requirements), blocking))
+	}
+
+	// the interfaces offered by the listed providers
+	providers := make(map[string]string)
+	complete := true
+	seen := make(map[string]bool)
+	for _, relation := range relations {
+		// the relations controller doesn't trim the names, so a name with
+		// spaces never matches a Service
+		if errs := validation.IsDNS1035Label(relation); len(errs) > 0 {
+			problems = append(problems, fmt.Sprintf("invalid provider name %q in tengu.io/relations: %s", relation, strings.Join(errs, ", ")))
+			complete = false
+			continue
+		}
+		if seen[relation] {
+			problems = append(problems, fmt.Sprintf("provider %q is listed twice in tengu.io/relations", relation))
+			continue
+		}
+		seen[relation] = true
+
+		service, err := client.CoreV1().Services(namespace).Get(relation, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			problems = append(problems, fmt.Sprintf("provider Service %q doesn't exist", relation))
+			complete = false
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to look up provider Service %s/%s: %v", namespace, relation, err)
+			complete = false
+			continue
+		}
+		provides := service.Labels["tengu.io/provides"]
+		if provides == "" {
+			problems = append(problems, fmt.Sprintf("Service %q isn't a provider: it has no tengu.io/provides label", relation))
+			complete = false
+			continue
+		}
+		// interfaces are matched case-insensitively, like their variables
+		if other, ok := providers[strings.ToUpper(provides)]; ok {
+			problems = append(problems, fmt.Sprintf("interface %q is provided by both %q and %q", provides, other, relation))
+			continue
+		}
+		providers[strings.ToUpper(provides)] = relation
+	}
+
+	// when a provider is missing, the interfaces it would offer are
+	// unknown
+	if complete {
+		for _, r := range requirements {
+			if _, ok := providers[r.Var()]; !ok && r.Blocking() {
+				problems = append(problems, fmt.Sprintf("interface %q isn't provided by any Service in tengu.io/relations", r.Name))
+			}
+		}
+	}
+	return problems
+}
+
+// namespaceValidationMode returns the validation mode of the namespace.
+func (whsvr *WebhookServer) namespaceValidationMode(namespace string) string {
+	item, exists, err := whsvr.namespaces.GetByKey(namespace)
+	if err != nil || !exists {
+		log.Warnf("Failed to look up namespace %s, using validation mode %q: %v", namespace, whsvr.validationMode, err)
+		return whsvr.validationMode
+	}
+	mode := item.(*corev1.Namespace).Labels["tengu.io/validation"]
+	if mode == "" {
+		return whsvr.validationMode
+	}
+	if !validValidationMode(mode) {
+		log.Warnf("Unknown validation mode %q on namespace %s, using %q", mode, namespace, whsvr.validationMode)
+		return whsvr.validationMode
+	}
+	return mode
+}
+
+// validate checks the relation declarations of consumers and providers.
+func (whsvr *WebhookServer) validate(req *v1beta1.AdmissionRequest) *admissionResponse {
+	if req.Kind.Kind == "Service" {
+		return whsvr.validateProvider(req)
+	}
+	return whsvr.validateConsumer(req)
+}
+
+// consumerDeclarationChanged returns true when the update changes the relation
+// declaration of the consumer.
+func consumerDeclarationChanged(req *v1beta1.AdmissionRequest, deployment *appsv1.Deployment) bool {
+	if req.Operation != v1beta1.Update {
+		return true
+	}
+	var old appsv1.Deployment
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+		return true
+	}
+	return old.Annotations["tengu.io/relations"] != deployment.Annotations["tengu.io/relations"] ||
+		old.Annotations["tengu.io/consumes"] != deployment.Annotations["tengu.io/consumes"]
+}
+
+// validateConsumer checks the relation declaration of a consumer. Depending on
+// the validation mode of its namespace, an invalid declaration is rejected or
+// admitted with warnings. Updates that don't change the declaration are always
+// admitted: the providers of a consumer come and go, and the relations
+// controller has to keep patching the consumer when they do.
+func (whsvr *WebhookServer) validateConsumer(req *v1beta1.AdmissionRequest) *admissionResponse {
+	allowed := &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{Allowed: true}}
+	var deployment appsv1.Deployment
+	if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
+		log.Errorf("Could not unmarshal raw object: %v", err)
+		return &admissionResponse{
+			AdmissionResponse: v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			},
+		}
+	}
+	for _, namespace := range whsvr.ignoredNamespaceList() {
+		if req.Namespace == namespace {
+			return allowed
+		}
+	}
+	if deployment.Annotations["tengu.io/relations"] == "" && deployment.Annotations["tengu.io/consumes"] == "" {
+		return allowed
+	}
+	if !consumerDeclarationChanged(req, &deployment) {
+		return allowed
+	}
+
+	problems := relationProblems(whsvr.clientset, req.Namespace, deployment.Annotations)
+	if len(problems) == 0 {
+		return allowed
+	}
+	mode := whsvr.namespaceValidationMode(req.Namespace)
+	log.Warnf("Relation declaration of %s/%s is invalid (%s): %s", req.Namespace, deployment.Name, mode, strings.Join(problems, "; "))
+	if mode == validationWarn {
+		allowed.Warnings = problems
+		return allowed
+	}
+	return &admissionResponse{
+		AdmissionResponse: v1beta1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: "invalid relation declaration: " + strings.Join(problems, "; "),
+			},
+		},
+	}
+}
+
+// providerProblems returns what is wrong with the provider declaration of the
+// service: an interface name that isn't valid, no externalName to pass to the
+// consumers, or an interface that another provider in the namespace offers
+// already, so the relation would be ambiguous.
+func providerProblems(client kubernetes.Interface, service *corev1.Service) []string {
+	var problems []string
+	provides := service.Labels["tengu.io/provides"]
+	if err := requirement.ValidateName(provides); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid tengu.io/provides: %v", err))
+	}
+	// the relations controller passes the externalName to the consumers
+	if service.Spec.ExternalName == "" {
+		problems = append(problems, "a provider needs an externalName")
+	}
+
+	others, err := client.CoreV1().Services(service.Namespace).List(metav1.ListOptions{
+		LabelSelector: "tengu.io/provides",
+	})
+	if err != nil {
+		log.Warnf("Failed to list providers in namespace %s: %v", service.Namespace, err)
+		return problems
+	}
+	for _, other := range others.Items {
+		if other.Name == service.Name || other.DeletionTimestamp != nil {
+			continue
+		}
+		if strings.EqualFold(other.Labels["tengu.io/provides"], provides) {
+			problems = append(problems, fmt.Sprintf("interface %q is already provided by Service %q", provides, other.Name))
+		}
+	}
+	return problems
+}
+
+// providerDeclarationChanged returns true when the update changes what the
+// service provides, or makes it a provider.
+func providerDeclarationChanged(req *v1beta1.AdmissionRequest, service *corev1.Service) bool {
+	if req.Operation != v1beta1.Update {
+		return true
+	}
+	var old corev1.Service
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+		return true
+	}
+	return old.Labels["tengu.io/provides"] != service.Labels["tengu.io/provides"] ||
+		old.Spec.ExternalName != service.Spec.ExternalName
+}
+
+// validateProvider rejects provider services with an incomplete or ambiguous
+// declaration. Updates that don't change the declaration are always admitted,
+// so the relations controller can still manage the finalizer of providers
+// that were created before the webhook validated them.
+func (whsvr *WebhookServer) validateProvider(req *v1beta1.AdmissionRequest) *admissionResponse {
+	allowed := &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{Allowed: true}}
+	var service corev1.Service
+	if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+		log.Errorf("Could not unmarshal raw object: %v", err)
+		return &admissionResponse{
+			AdmissionResponse: v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			},
+		}
+	}
+	if service.Namespace == "" {
+		service.Namespace = req.Namespace
+	}
+	for _, namespace := range whsvr.ignoredNamespaceList() {
+		if service.Namespace == namespace {
+			return allowed
+		}
+	}
+	if service.Labels["tengu.io/provides"] == "" || service.DeletionTimestamp != nil || !providerDeclarationChanged(req, &service) {
+		return allowed
+	}
+
+	problems := providerProblems(whsvr.clientset, &service)
+	if len(problems) == 0 {
+		return allowed
+	}
+	log.Warnf("Rejecting provider %s/%s: %s", service.Namespace, service.Name, strings.Join(problems, "; "))
+	return &admissionResponse{
+		AdmissionResponse: v1beta1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: "invalid provider declaration: " + strings.Join(problems, "; "),
+			},
+		},
+	}
+}
+
+// serveValidate handles the requests of the validating webhook.
+func (whsvr *WebhookServer) serveValidate(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, whsvr.validate)
+}
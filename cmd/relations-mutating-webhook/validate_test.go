@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// newTestClient returns a client of an API server that only knows the given
+// services, in the `default` namespace.
+func newTestClient(t *testing.T, services ...corev1.Service) kubernetes.Interface {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for _, service := range services {
+			if r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/default/services/"+service.Name {
+				service.TypeMeta = metav1.TypeMeta{Kind: "Service", APIVersion: "v1"}
+				json.NewEncoder(w).Encode(service)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}))
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func provider(name, provides string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"tengu.io/provides": provides},
+		},
+		Spec: corev1.ServiceSpec{ExternalName: name + ".example"},
+	}
+}
+
+func TestRelationProblems(t *testing.T) {
+	client := newTestClient(t, provider("postgres", "db"), provider("redis", "cache"), corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "plain"},
+	})
+	tests := []struct {
+		relations string
+		consumes  string
+		// want are substrings of the expected problems, in order
+		want []string
+	}{
+		{relations: "postgres", consumes: "db"},
+		{relations: "postgres,redis", consumes: "db,cache"},
+		{relations: "postgres", consumes: "db,cache=localhost"},
+		{relations: "postgres", consumes: "db,cache?"},
+		{relations: "postgres,redis", consumes: "db,cache?"},
+		{relations: "", consumes: "cache?"},
+		{relations: "", consumes: "db", want: []string{"lists 0 providers", "\"db\" isn't provided"}},
+		{relations: "redis", consumes: "db,cache?", want: []string{"\"db\" isn't provided"}},
+		{relations: "postgres,redis", consumes: "db", want: []string{"lists 2 providers"}},
+		{relations: "postgres,postgres", consumes: "db,cache?", want: []string{"listed twice"}},
+		{relations: "missing", consumes: "db", want: []string{"\"missing\" doesn't exist"}},
+		{relations: "plain", consumes: "db", want: []string{"isn't a provider"}},
+		{relations: "my db", consumes: "db", want: []string{"invalid provider name"}},
+		{relations: "postgres", consumes: "db,db", want: []string{"invalid tengu.io/consumes"}},
+	}
+	for _, test := range tests {
+		got := relationProblems(client, "default", map[string]string{
+			"tengu.io/relations": test.relations,
+			"tengu.io/consumes":  test.consumes,
+		})
+		if len(got) != len(test.want) {
+			t.Errorf("relationProblems(%q, %q) = %q, want %d problems", test.relations, test.consumes, got, len(test.want))
+			continue
+		}
+		for i, want := range test.want {
+			if !strings.Contains(got[i], want) {
+				t.Errorf("relationProblems(%q, %q) = %q, want %q", test.relations, test.consumes, got, want)
+			}
+		}
+	}
+}
@@ -1,59 +1,110 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/deploymentpatch"
-	"gopkg.in/yaml.v2"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/orconlib"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/reload"
+	"gitlab.ilabt.imec.be/tengu/orcon-lennart/internal/requirement"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
 	runtimeScheme = runtime.NewScheme()
-	codecs        = serializer.NewCodecFactory(runtimeScheme)
-	deserializer  = codecs.UniversalDeserializer()
 
 	defaulter = runtime.ObjectDefaulter(runtimeScheme)
-
-	clientset = createK8sClient()
 )
 
-var ignoredNamespaces = []string{
+// defaultIgnoredNamespaces are the namespaces the webhook leaves alone unless
+// the `-ignoredNamespaces` flag says otherwise.
+var defaultIgnoredNamespaces = []string{
 	metav1.NamespaceSystem,
 	metav1.NamespacePublic,
 }
 
-//Config ...
+// Config ...
 type Config struct {
-	InitContainers []corev1.Container `yaml:"initContainers"`
+	InitContainers []corev1.Container `json:"initContainers"`
+	// Sidecars are injected in consumers with the `tengu.io/sidecar`
+	// annotation.
+	Sidecars []corev1.Container `json:"sidecars"`
+	// Profiles are alternative settings for the injected containers, which
+	// consumers select with the `injector.tengu.io/profile` annotation.
+	Profiles map[string]Profile `json:"profiles"`
+	// IgnoredNamespaces are left alone, in addition to the namespaces of the
+	// `-ignoredNamespaces` flag.
+	IgnoredNamespaces []string `json:"ignoredNamespaces"`
+	// ObjectSelector selects the workloads that are injected by their
+	// labels; all workloads are injected when it isn't set.
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector"`
+
+	// selector is the parsed ObjectSelector.
+	selector labels.Selector
 }
 
-//WebhookServer ...
+// WebhookServer ...
 type WebhookServer struct {
-	initcontainerConfig *Config
-	server              *http.Server
+	// config holds the *Config in use. It is swapped as a whole when the
+	// configuration file changes, so a request sees a single configuration.
+	config atomic.Value
+	server *http.Server
+	// validationMode is used for namespaces without the
+	// `tengu.io/validation` label.
+	validationMode string
+	// namespaceConfigMap is the ConfigMap that overrides the injected
+	// containers in its namespace.
+	namespaceConfigMap string
+	// ignoredNamespaces are left alone, next to those of the configuration.
+	ignoredNamespaces []string
+	// clientset looks up providers and owners during admission.
+	clientset kubernetes.Interface
+	// namespaces and namespaceConfigMaps cache the namespaces and their
+	// namespaceConfigMap ConfigMaps.
+	namespaces          cache.Indexer
+	namespaceConfigMaps cache.Indexer
+	// ownerResources caches the resources of the owner kinds of pods, keyed
+	// by `apiVersion/kind`.
+	ownerResources sync.Map
 }
 
-//WhSvrParameters ...
+// WhSvrParameters ...
 type WhSvrParameters struct {
-	port                 int    // webhook server port
-	certFile             string // path to the x509 certificate for https
-	keyFile              string // path to the x509 private key matching `CertFile`
-	initcontainerCfgFile string // path to the initcontainer injector configuration file
+	port                 int           // webhook server port
+	certFile             string        // path to the x509 certificate for https
+	keyFile              string        // path to the x509 private key matching `CertFile`
+	initcontainerCfgFile string        // path to the initcontainer injector configuration file
+	configReloadPeriod   time.Duration // how often the configuration file is checked for changes
+	certReloadPeriod     time.Duration // how often the key pair is checked for changes
+	selfManagedCerts     bool          // generate the certificates instead of reading them from files
+	certSecret           string        // Secret holding the self-managed certificates
+	serviceName          string        // service the API server reaches the webhook through
+	namespace            string        // namespace of the service and the Secret
+	webhookConfigName    string        // MutatingWebhookConfiguration whose caBundle is managed
+	validatingConfigName string        // ValidatingWebhookConfiguration whose caBundle is managed
+	validationMode       string        // default validation mode of namespaces
+	namespaceConfigMap   string        // ConfigMap with the injection overrides of a namespace
+	ignoredNamespaces    string        // comma-separated namespaces that are left alone
+	kubeconfig           string        // kubeconfig used outside of a cluster
 }
 
 func init() {
@@ -63,17 +114,22 @@ func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
 }
 
-func createK8sClient() *kubernetes.Clientset {
+// getKubernetesClient returns a client for the cluster the webhook runs in. Outside
+// of a cluster, for local development, it uses the given kubeconfig or else
+// `~/.kube/config`.
+func getKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		panic(err.Error())
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
+		log.Infof("getClusterConfig: %v", err)
+		if kubeconfig == "" {
+			kubeconfig = os.Getenv("HOME") + "/.kube/config"
+		}
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return clientset
+	return kubernetes.NewForConfig(config)
 }
 
 // (https://github.com/kubernetes/kubernetes/issues/57982)
@@ -85,24 +141,13 @@ func applyDefaultsWorkaround(containers []corev1.Container) {
 	})
 }
 
-func loadConfig(configFile string) (*Config, error) {
-	data, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return nil, err
-	}
-	log.Infof("New configuration: sha256sum %x", sha256.Sum256(data))
-
-	var cfg Config
-
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
-	}
-
-	return &cfg, nil
+// ignoredNamespaceList returns the namespaces the webhook leaves alone.
+func (whsvr *WebhookServer) ignoredNamespaceList() []string {
+	return append(append([]string{}, whsvr.ignoredNamespaces...), whsvr.currentConfig().IgnoredNamespaces...)
 }
 
 // Check whether the target resource needs to be mutated
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) []string {
+func mutationRequired(ignoredList []string, selector labels.Selector, metadata *metav1.ObjectMeta) []string {
 	log.Infof("Called")
 	processingRequired := []string{}
 	// Skip special kubernetes system namespaces
@@ -112,6 +157,10 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) []strin
 			return processingRequired
 		}
 	}
+	if selector != nil && !selector.Matches(labels.Set(metadata.Labels)) {
+		log.Infof("Skip mutation for %v/%v: its labels don't match the object selector %v", metadata.Namespace, metadata.Name, selector)
+		return processingRequired
+	}
 	annotations := metadata.GetAnnotations()
 	if annotations == nil {
 		annotations = map[string]string{}
@@ -124,11 +173,19 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) []strin
 	status := strings.ToLower(annotations["injector.tengu.io/status"])
 	// consumes := strings.ToLower(labels["tengu.io/consumes"])
 	provides := strings.ToLower(labels["tengu.io/provides"])
-	consumes := strings.ToLower(annotations["tengu.io/consumes"])
+	consumes := strings.Trim(strings.ToLower(annotations["tengu.io/consumes"]), " ,")
 
 	log.Infof("%s; %s; %s", status, consumes, provides)
 
-	if consumes != "" && !(status == "injected") {
+	if annotations["injector.tengu.io/inject"] == "false" {
+		log.Infof("Skip mutation for %v/%v: injection is disabled", metadata.Namespace, metadata.Name)
+		return processingRequired
+	}
+
+	// consumers are mutated on every CREATE and UPDATE, so the injected
+	// containers follow changes to the annotations and are repaired when
+	// they are removed
+	if consumes != "" {
 		processingRequired = append(processingRequired, "consumes")
 	}
 	if provides != "" {
@@ -139,12 +196,278 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) []strin
 	return processingRequired
 }
 
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
-	// TODO: we currently only support Deployments. We should make this more
-	// generic so we can also support individual pods etc.
+// requirementEnv validates the relations a consumer declares and translates
+// them into the environment of the init container. The relations are listed in
+// the `tengu.io/consumes` annotation, see requirement.Parse. The check of a
+// relation can also be set in the `tengu.io/checks` annotation, a
+// comma-separated list of `interface=check` pairs, for example
+// `db=tcp:5432,sse=http:8080/healthz`. The check of each interface is passed
+// in its own `TENGU_CHECK_<INTERFACE>` variable. The `tengu.io/timeout`
+// annotation is passed in `TENGU_TIMEOUT`.
+func requirementEnv(annotations map[string]string) ([]corev1.EnvVar, error) {
+	requirements, err := requirement.Parse(annotations["tengu.io/consumes"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid tengu.io/consumes: %v", err)
+	}
+	checks := make(map[string]requirement.Check)
+	for _, r := range requirements {
+		if r.Check.Kind != requirement.CheckEnv {
+			checks[r.Var()] = r.Check
+		}
+	}
+	if annotation := strings.TrimSpace(annotations["tengu.io/checks"]); annotation != "" {
+		for _, entry := range strings.Split(annotation, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid tengu.io/checks: expected interface=check, got %q", entry)
+			}
+			name := strings.ToUpper(strings.TrimSpace(parts[0]))
+			if _, exists := checks[name]; exists {
+				return nil, fmt.Errorf("invalid tengu.io/checks: check of %q is set more than once", parts[0])
+			}
+			check, err := requirement.ParseCheck(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid tengu.io/checks: %v", err)
+			}
+			checks[name] = check
+		}
+	}
+
+	// the init container only waits for the relations the consumer can't
+	// start without; the relations controller injects the others later
+	var blocking []requirement.Requirement
+	for _, r := range requirements {
+		if r.Blocking() {
+			blocking = append(blocking, r)
+		}
+	}
+	env := []corev1.EnvVar{{
+		Name:  "TENGU_REQUIRED_VARS",
+		Value: strings.Join(requirement.Vars(blocking), ","),
+	}}
+	for _, r := range requirements {
+		check, ok := checks[r.Var()]
+		if !ok {
+			continue
+		}
+		delete(checks, r.Var())
+		if !r.Blocking() {
+			continue
+		}
+		env = append(env, corev1.EnvVar{
+			Name:  "TENGU_CHECK_" + r.Var(),
+			Value: check.String(),
+		})
+	}
+	for name := range checks {
+		return nil, fmt.Errorf("invalid tengu.io/checks: %q isn't in tengu.io/consumes", name)
+	}
+	if timeout := strings.TrimSpace(annotations["tengu.io/timeout"]); timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tengu.io/timeout: %v", err)
+		}
+		if duration < 0 {
+			return nil, fmt.Errorf("invalid tengu.io/timeout: must not be negative")
+		}
+		env = append(env, corev1.EnvVar{
+			Name:  "TENGU_TIMEOUT",
+			Value: timeout,
+		})
+	}
+	return env, nil
+}
+
+// validateRolloutPolicy rejects the `configmap` rollout policy for consumers
+// whose init container reads its environment. Relations with that policy are
+// never injected in the environment, so the init container would wait for them
+// forever.
+func validateRolloutPolicy(annotations map[string]string) error {
+	if orconlib.LiveRelations(annotations) {
+		return nil
+	}
+	for _, entry := range strings.Split(annotations["tengu.io/rollout-policy"], ",") {
+		policy := entry
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			policy = parts[1]
+		}
+		if strings.TrimSpace(policy) == "configmap" {
+			return fmt.Errorf("rollout policy configmap needs tengu.io/init-mode volume or api, the init container can't see relations that are only in the ConfigMap")
+		}
+	}
+	return nil
+}
+
+// relationSourceEnv returns the environment that tells the init container
+// where to read the relations of the consumer, as set by the
+// `tengu.io/init-mode` annotation, and whether the relations ConfigMap needs
+// to be mounted in the init container. With `env` (default) the init container
+// reads its own environment, which only changes when the pod is recreated.
+// With `volume` or `api` it reads the relations ConfigMap, which the relations
+// controller keeps up to date, so the pod starts without a new rollout.
+// Consumers with a sidecar don't get their relations in their environment, so
+// their init container reads the mounted ConfigMap unless it uses `api`.
+func relationSourceEnv(deployment *appsv1.Deployment) ([]corev1.EnvVar, bool) {
+	mode := deployment.Annotations["tengu.io/init-mode"]
+	if deployment.Annotations["tengu.io/sidecar"] != "" && mode != "api" {
+		mode = "volume"
+	}
+	switch mode {
+	case "", "env":
+		return nil, false
+	case "volume":
+		return []corev1.EnvVar{
+			{Name: "TENGU_RELATIONS_SOURCE", Value: "volume"},
+			{Name: "TENGU_RELATIONS_DIR", Value: orconlib.RelationsMountPath},
+		}, true
+	case "api":
+		return []corev1.EnvVar{
+			{Name: "TENGU_RELATIONS_SOURCE", Value: "api"},
+			{Name: "TENGU_RELATIONS_CONFIGMAP", Value: orconlib.RelationsConfigMapName(deployment.Name)},
+		}, false
+	default:
+		log.Warnf("Unknown init mode %q on %s/%s, using env", mode, deployment.Namespace, deployment.Name)
+		return nil, false
+	}
+}
+
+// injectSidecar adds the sidecars that keep the relations of the consumer up to
+// date in a shared volume, as requested by the `tengu.io/sidecar` annotation.
+// The annotation tells how the application is notified of changes, see
+// reload.Parse. Consumers with a sidecar are live consumers: the sidecars read
+// the relations ConfigMap, which the caller mounts.
+func injectSidecar(deployment *appsv1.Deployment, patch *deploymentpatch.DeploymentPatch, sidecars []corev1.Container) error {
+	annotation := deployment.Annotations["tengu.io/sidecar"]
+	if annotation == "" {
+		return nil
+	}
+	r, err := reload.Parse(annotation)
+	if err != nil {
+		return fmt.Errorf("invalid tengu.io/sidecar: %v", err)
+	}
+	if len(sidecars) == 0 {
+		return fmt.Errorf("tengu.io/sidecar is set, but no sidecars are configured in the webhook")
+	}
+	requirements, err := requirement.Parse(deployment.Annotations["tengu.io/consumes"])
+	if err != nil {
+		return fmt.Errorf("invalid tengu.io/consumes: %v", err)
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "TENGU_MODE", Value: "sidecar"},
+		{Name: "TENGU_WATCH_VARS", Value: strings.Join(requirement.Vars(requirements), ",")},
+		{Name: "TENGU_RELATIONS_SOURCE", Value: "volume"},
+		{Name: "TENGU_RELATIONS_DIR", Value: orconlib.RelationsMountPath},
+		{Name: "TENGU_OUTPUT_DIR", Value: orconlib.SidecarMountPath},
+		{Name: "TENGU_RELOAD", Value: r.String()},
+	}
+	for _, container := range sidecars {
+		// the configuration is shared by all requests, so modify a copy
+		container = *container.DeepCopy()
+		container.Env = append(container.Env, env...)
+		container.VolumeMounts = append(container.VolumeMounts,
+			corev1.VolumeMount{
+				Name:      orconlib.RelationsVolumeName,
+				MountPath: orconlib.RelationsMountPath,
+				ReadOnly:  true,
+			},
+			corev1.VolumeMount{
+				Name:      orconlib.SidecarVolumeName,
+				MountPath: orconlib.SidecarMountPath,
+			},
+		)
+		if deployment.Annotations["tengu.io/status-file"] == "true" {
+			// the status volume is mounted in all containers
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      orconlib.StatusVolumeName,
+				MountPath: orconlib.StatusMountPath,
+				ReadOnly:  true,
+			})
+		}
+		patch.SetPodContainer(container)
+	}
+	patch.AppendToPodVolumes(corev1.Volume{
+		Name: orconlib.SidecarVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+	patch.AppendToPodVolumeMounts(corev1.VolumeMount{
+		Name:      orconlib.SidecarVolumeName,
+		MountPath: orconlib.SidecarMountPath,
+		ReadOnly:  true,
+	})
+	if r.Kind == reload.SIGHUP {
+		// the sidecar can only signal the application when it sees its
+		// processes
+		patch.EnablePodShareProcessNamespace()
+	}
+	return nil
+}
+
+// controllerEnv returns the variables the relations controller injected in the
+// existing version of the given init container, as recorded in the
+// `tengu.io/injected-vars` annotation. They are kept when the init container is
+// replaced, so the webhook doesn't undo the patches of the controller.
+func controllerEnv(deployment *appsv1.Deployment, container corev1.Container) []corev1.EnvVar {
+	injected := injectedVars(deployment)
+	var env []corev1.EnvVar
+	for _, existing := range deployment.Spec.Template.Spec.InitContainers {
+		if existing.Name != container.Name {
+			continue
+		}
+		for _, v := range existing.Env {
+			if !containsString(injected, v.Name) {
+				continue
+			}
+			// the webhook's own variables take precedence
+			set := false
+			for _, own := range container.Env {
+				if own.Name == v.Name {
+					set = true
+					break
+				}
+			}
+			if !set {
+				env = append(env, v)
+			}
+		}
+	}
+	return env
+}
+
+// containsString returns true when the list contains the string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// invalid returns the response that rejects an object with an invalid relation
+// declaration.
+func invalid(deployment *appsv1.Deployment, err error) *v1beta1.AdmissionResponse {
+	log.Warnf("Rejecting %s/%s: %v", deployment.Namespace, deployment.Name, err)
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: err.Error(),
+		},
+	}
+}
+
+// mutate injects the init container, and the sidecars when requested, in
+// consumers.
+func (whsvr *WebhookServer) mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	if req.Kind.Kind == "Pod" {
+		return whsvr.mutatePod(req)
+	}
 	var deployment appsv1.Deployment
-	log.Infof(string(req.Object.Raw))
+	log.Infof("Object: %s", req.Object.Raw)
 	if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
 		log.Errorf("Could not unmarshal raw object: %v", err)
 		return &v1beta1.AdmissionResponse{
@@ -153,51 +476,23 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 			},
 		}
 	}
+	if deployment.Namespace == "" {
+		deployment.Namespace = req.Namespace
+	}
 
 	log.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, deployment.Name, req.UID, req.Operation, req.UserInfo)
+	// mutating has no side effects, so a dry run is evaluated like any
+	// other request
+	if req.DryRun != nil && *req.DryRun {
+		log.Infof("Dry run for %s/%s", req.Namespace, deployment.Name)
+	}
 
-	processingRequired := mutationRequired(ignoredNamespaces, &deployment.ObjectMeta)
+	processingRequired := mutationRequired(whsvr.ignoredNamespaceList(), whsvr.currentConfig().selector, &deployment.ObjectMeta)
 	for _, action := range processingRequired {
 		if action == "consumes" {
-			// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
-			applyDefaultsWorkaround(whsvr.initcontainerConfig.InitContainers)
-
-			consumes := strings.ToUpper(deployment.Annotations["tengu.io/consumes"])
-
-			deployment := deploymentpatch.New(deployment)
-			for _, container := range whsvr.initcontainerConfig.InitContainers {
-				// TODO: append required vars here
-				requiredVar := corev1.EnvVar{
-					Name:  "TENGU_REQUIRED_VARS",
-					Value: consumes,
-				}
-				container.Env = append(container.Env, requiredVar)
-				deployment.PrependToPodInitContainers(container)
-			}
-			deployment.AppendToAnnotations(map[string]string{
-				"injector.tengu.io/status": "injected",
-			})
-
-			patchBytes, err := deployment.GetPatchBytes()
-
-			if err != nil {
-				return &v1beta1.AdmissionResponse{
-					Result: &metav1.Status{
-						Message: err.Error(),
-					},
-				}
-			}
-
-			log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-			return &v1beta1.AdmissionResponse{
-				Allowed: true,
-				Patch:   patchBytes,
-				PatchType: func() *v1beta1.PatchType {
-					pt := v1beta1.PatchTypeJSONPatch
-					return &pt
-				}(),
-			}
+			patch := deploymentpatch.New(deployment)
+			return whsvr.injectConsumer(&deployment, patch, whsvr.prepopulate(req, &deployment, patch))
 		} else if action == "provides" {
 			// provides side is handled the `relations-controller`
 		} else {
@@ -211,56 +506,220 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 	}
 }
 
-func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+// prepopulate returns the relation data that is available when a consumer is
+// created, so a consumer whose providers already exist starts in a single
+// rollout instead of waiting for the relations controller. The variables are
+// recorded in the `tengu.io/injected-vars` annotation so the controller
+// manages them from then on. Relations with the `manual` rollout policy wait
+// for approval, so the controller rolls them out. Updates are left to the
+// controller, which applies the rollout policies, and live consumers read
+// their relations from the relations ConfigMap.
+func (whsvr *WebhookServer) prepopulate(req *v1beta1.AdmissionRequest, deployment *appsv1.Deployment, patch *deploymentpatch.DeploymentPatch) map[string]string {
+	if req.Operation != v1beta1.Create || orconlib.LiveRelations(deployment.Annotations) {
+		return nil
+	}
+	defaultPolicy, policies := orconlib.RolloutPolicies(deployment)
+	manual := func(provider string) bool {
+		policy, ok := policies[provider]
+		if !ok {
+			policy = defaultPolicy
 		}
+		return policy == orconlib.PolicyManual
+	}
+	relations := whsvr.availableRelations(deployment.Namespace, deployment.Annotations, manual)
+	if len(relations) == 0 {
+		return nil
+	}
+	injected := injectedVars(deployment)
+	for name := range relations {
+		if !containsString(injected, name) {
+			injected = append(injected, name)
+		}
+	}
+	sort.Strings(injected)
+	patch.AppendToAnnotations(map[string]string{
+		"tengu.io/injected-vars": strings.Join(injected, ","),
+	})
+	log.Infof("Injecting available relations %v in %s/%s", injected, deployment.Namespace, deployment.Name)
+	return relations
+}
+
+// injectedVars returns the variables recorded in the `tengu.io/injected-vars`
+// annotation of the deployment.
+func injectedVars(deployment *appsv1.Deployment) []string {
+	annotation := deployment.Annotations["tengu.io/injected-vars"]
+	if annotation == "" {
+		return []string{}
+	}
+	return strings.Split(annotation, ",")
+}
+
+// injectConsumer patches the consumer with the init container, its volumes and
+// the sidecars, as declared by the annotations of the consumer. The given
+// relation data is injected in all containers right away.
+func (whsvr *WebhookServer) injectConsumer(consumer *appsv1.Deployment, patch *deploymentpatch.DeploymentPatch, relations map[string]string) *v1beta1.AdmissionResponse {
+	env, err := requirementEnv(consumer.Annotations)
+	if err != nil {
+		return invalid(consumer, err)
+	}
+	if err := validateRolloutPolicy(consumer.Annotations); err != nil {
+		return invalid(consumer, err)
+	}
+	config, err := whsvr.consumerConfig(consumer)
+	if err != nil {
+		return invalid(consumer, err)
+	}
+	sourceEnv, mountRelations := relationSourceEnv(consumer)
+	env = append(env, sourceEnv...)
+	statusFile := consumer.Annotations["tengu.io/status-file"] == "true"
+	if statusFile {
+		env = append(env, corev1.EnvVar{
+			Name:  "TENGU_STATUS_FILE",
+			Value: orconlib.StatusMountPath + "/" + orconlib.StatusFileName,
+		})
+	}
+	configMapName := orconlib.RelationsConfigMapName(consumer.Name)
+	live := orconlib.LiveRelations(consumer.Annotations)
+	sidecar := consumer.Annotations["tengu.io/sidecar"] != ""
+
+	// remove the volumes of annotations that are gone, before the containers
+	// that mount them are replaced below
+	var staleVolumes []string
+	if !statusFile {
+		staleVolumes = append(staleVolumes, orconlib.StatusVolumeName)
+	}
+	if !live {
+		staleVolumes = append(staleVolumes, orconlib.RelationsVolumeName)
 	}
-	if len(body) == 0 {
-		log.Error("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
-		return
+	if !sidecar {
+		staleVolumes = append(staleVolumes, orconlib.SidecarVolumeName)
 	}
+	patch.RemoveFromPodVolumes(staleVolumes)
 
-	//verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		log.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect application/json", http.StatusUnsupportedMediaType)
-		return
+	// relation data that is available at admission is injected in the
+	// containers of the consumer and in the init container
+	if len(relations) > 0 {
+		patch.AppendToPodEnvironment(relations)
+		env = append(env, sortedEnv(relations)...)
+	}
+
+	for _, container := range config.InitContainers {
+		// the configuration is shared by all requests, so modify a copy
+		container = *container.DeepCopy()
+		container.Env = append(container.Env, env...)
+		// keep the relations the controller injected in the init container
+		container.Env = append(container.Env, controllerEnv(consumer, container)...)
+		if mountRelations {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      orconlib.RelationsVolumeName,
+				MountPath: orconlib.RelationsMountPath,
+				ReadOnly:  true,
+			})
+		}
+		if statusFile {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      orconlib.StatusVolumeName,
+				MountPath: orconlib.StatusMountPath,
+			})
+		}
+		patch.SetPodInitContainer(container)
+	}
+	if statusFile {
+		// the init container writes the status file, the containers of the
+		// consumer only read it
+		patch.AppendToPodVolumes(corev1.Volume{
+			Name: orconlib.StatusVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+		patch.AppendToPodVolumeMounts(corev1.VolumeMount{
+			Name:      orconlib.StatusVolumeName,
+			MountPath: orconlib.StatusMountPath,
+			ReadOnly:  true,
+		})
+	}
+	if live {
+		// the relations controller only keeps the relations of live consumers
+		// in the ConfigMap, so their containers read them from the mounted
+		// ConfigMap instead of their environment
+		patch.AppendToPodVolumeMounts(corev1.VolumeMount{
+			Name:      orconlib.RelationsVolumeName,
+			MountPath: orconlib.RelationsMountPath,
+			ReadOnly:  true,
+		})
+		// the ConfigMap is created by the relations controller once a relation
+		// is available, so it is optional until then
+		optional := true
+		patch.AppendToPodVolumes(corev1.Volume{
+			Name: orconlib.RelationsVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+					Optional:             &optional,
+				},
+			},
+		})
+	}
+	// the sidecars replace existing ones, so they come after all changes to
+	// the volume mounts of the containers
+	if err := injectSidecar(consumer, patch, config.Sidecars); err != nil {
+		return invalid(consumer, err)
 	}
+	if !sidecar {
+		// removing containers shifts the indexes of the others, so this
+		// comes last
+		var staleSidecars []string
+		for _, container := range config.Sidecars {
+			staleSidecars = append(staleSidecars, container.Name)
+		}
+		patch.RemoveFromPodContainers(staleSidecars)
+	}
+	patch.AppendToAnnotations(map[string]string{
+		"injector.tengu.io/status": "injected",
+	})
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		log.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
+	patchBytes, err := patch.GetPatchBytes()
+
+	if err != nil {
+		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
-	} else {
-		admissionResponse = whsvr.mutate(&ar)
 	}
 
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+	if len(patchBytes) == 0 {
+		log.Infof("%s/%s is up to date", consumer.Namespace, consumer.Name)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
 		}
 	}
-
-	resp, err := json.Marshal(admissionReview)
-	if err != nil {
-		log.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+	log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	return &v1beta1.AdmissionResponse{
+		Allowed: true,
+		Patch:   patchBytes,
+		PatchType: func() *v1beta1.PatchType {
+			pt := v1beta1.PatchTypeJSONPatch
+			return &pt
+		}(),
 	}
-	log.Infof("Ready to write response ...")
-	if _, err := w.Write(resp); err != nil {
-		log.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+}
+
+// sortedEnv returns the given variables sorted by name, so the injected
+// containers don't change between requests.
+func sortedEnv(vars map[string]string) []corev1.EnvVar {
+	env := make([]corev1.EnvVar, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
 	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	return env
+}
+
+// serveMutate handles the requests of the mutating webhook.
+func (whsvr *WebhookServer) serveMutate(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, func(req *v1beta1.AdmissionRequest) *admissionResponse {
+		return &admissionResponse{AdmissionResponse: *whsvr.mutate(req)}
+	})
 }
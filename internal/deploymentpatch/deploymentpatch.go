@@ -3,17 +3,29 @@ package deploymentpatch
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// DeploymentPatch is used to modify a Deployment resource using jsonpatch
+// DeploymentPatch is used to modify a Deployment resource using jsonpatch. It
+// can also modify a Pod, which is handled as a Deployment whose pod template is
+// the Pod itself.
 type DeploymentPatch struct {
-	deployment appsv1.Deployment
-	patchList  []PatchOperation
+	// meta is the metadata of the object and template its pod template; for a
+	// Pod, meta points to the metadata of template.
+	meta      *metav1.ObjectMeta
+	template  *corev1.PodTemplateSpec
+	patchList []PatchOperation
+
+	// templateMetaPath and templateSpecPath are the paths of the metadata and
+	// the spec of the pod template.
+	templateMetaPath string
+	templateSpecPath string
 
 	// Internal vars
 	labelsEnsured            bool
@@ -22,6 +34,11 @@ type DeploymentPatch struct {
 	podAnnotationsEnsured    bool
 	podEnvironmentEnsured    bool
 	podInitContainersEnsured bool
+	podVolumesEnsured        bool
+	podVolumeMountsEnsured   bool
+	// prependedInitContainers shifts the indexes of the original init
+	// containers
+	prependedInitContainers int
 }
 
 // PatchOperation represents a single jsonpatch operation.
@@ -34,14 +51,33 @@ type PatchOperation struct {
 // New creates a new DeploymentPatch object
 func New(deployment appsv1.Deployment) *DeploymentPatch {
 	pd := &DeploymentPatch{
-		deployment: deployment,
+		meta:             &deployment.ObjectMeta,
+		template:         &deployment.Spec.Template,
+		templateMetaPath: "/spec/template/metadata",
+		templateSpecPath: "/spec/template/spec",
+	}
+	return pd
+}
+
+// NewForPod creates a new DeploymentPatch object that modifies a Pod. The pod
+// template of the patch is the Pod itself.
+func NewForPod(pod corev1.Pod) *DeploymentPatch {
+	template := &corev1.PodTemplateSpec{
+		ObjectMeta: pod.ObjectMeta,
+		Spec:       pod.Spec,
+	}
+	pd := &DeploymentPatch{
+		meta:             &template.ObjectMeta,
+		template:         template,
+		templateMetaPath: "/metadata",
+		templateSpecPath: "/spec",
 	}
 	return pd
 }
 
 func (d *DeploymentPatch) ensureLabelsExist() {
 	if !d.labelsEnsured {
-		if len(d.deployment.Labels) == 0 {
+		if len(d.meta.Labels) == 0 {
 			d.patchList = append(d.patchList, PatchOperation{
 				Op:    "add",
 				Path:  "/metadata/labels",
@@ -53,11 +89,16 @@ func (d *DeploymentPatch) ensureLabelsExist() {
 }
 
 func (d *DeploymentPatch) ensurePodLabelsExist() {
+	if &d.template.ObjectMeta == d.meta {
+		// a Pod has no separate template labels
+		d.ensureLabelsExist()
+		return
+	}
 	if !d.podLabelsEnsured {
-		if len(d.deployment.Spec.Template.Labels) == 0 {
+		if len(d.template.Labels) == 0 {
 			d.patchList = append(d.patchList, PatchOperation{
 				Op:    "add",
-				Path:  "/spec/template/metadata/labels",
+				Path:  d.templateMetaPath + "/labels",
 				Value: struct{}{},
 			})
 		}
@@ -67,7 +108,7 @@ func (d *DeploymentPatch) ensurePodLabelsExist() {
 
 func (d *DeploymentPatch) ensureAnnotationsExist() {
 	if !d.annotationsEnsured {
-		if len(d.deployment.Annotations) == 0 {
+		if len(d.meta.Annotations) == 0 {
 			d.patchList = append(d.patchList, PatchOperation{
 				Op:    "add",
 				Path:  "/metadata/annotations",
@@ -79,11 +120,16 @@ func (d *DeploymentPatch) ensureAnnotationsExist() {
 }
 
 func (d *DeploymentPatch) ensurePodAnnotationsExist() {
+	if &d.template.ObjectMeta == d.meta {
+		// a Pod has no separate template annotations
+		d.ensureAnnotationsExist()
+		return
+	}
 	if !d.podAnnotationsEnsured {
-		if len(d.deployment.Spec.Template.Labels) == 0 {
+		if len(d.template.Annotations) == 0 {
 			d.patchList = append(d.patchList, PatchOperation{
 				Op:    "add",
-				Path:  "/spec/template/metadata/annotations",
+				Path:  d.templateMetaPath + "/annotations",
 				Value: struct{}{},
 			})
 		}
@@ -93,11 +139,20 @@ func (d *DeploymentPatch) ensurePodAnnotationsExist() {
 
 func (d *DeploymentPatch) ensurePodEnvironmentExists() {
 	if !d.podEnvironmentEnsured {
-		for index := range d.deployment.Spec.Template.Spec.Containers {
-			if len(d.deployment.Spec.Template.Spec.Containers[index].Env) == 0 {
+		for index := range d.template.Spec.Containers {
+			if len(d.template.Spec.Containers[index].Env) == 0 {
 				d.patchList = append(d.patchList, PatchOperation{
 					Op:    "add",
-					Path:  "/spec/template/spec/containers/" + strconv.Itoa(index) + "/env",
+					Path:  d.templateSpecPath + "/containers/" + strconv.Itoa(index) + "/env",
+					Value: []struct{}{},
+				})
+			}
+		}
+		for index := range d.template.Spec.InitContainers {
+			if len(d.template.Spec.InitContainers[index].Env) == 0 {
+				d.patchList = append(d.patchList, PatchOperation{
+					Op:    "add",
+					Path:  d.templateSpecPath + "/initContainers/" + strconv.Itoa(index+d.prependedInitContainers) + "/env",
 					Value: []struct{}{},
 				})
 			}
@@ -108,10 +163,10 @@ func (d *DeploymentPatch) ensurePodEnvironmentExists() {
 
 func (d *DeploymentPatch) ensurePodInitContainersExists() {
 	if !d.podInitContainersEnsured {
-		if len(d.deployment.Spec.Template.Spec.InitContainers) == 0 {
+		if len(d.template.Spec.InitContainers) == 0 {
 			d.patchList = append(d.patchList, PatchOperation{
 				Op:    "add",
-				Path:  "/spec/template/spec/initContainers",
+				Path:  d.templateSpecPath + "/initContainers",
 				Value: []struct{}{},
 			})
 		}
@@ -119,11 +174,39 @@ func (d *DeploymentPatch) ensurePodInitContainersExists() {
 	}
 }
 
+func (d *DeploymentPatch) ensurePodVolumesExist() {
+	if !d.podVolumesEnsured {
+		if len(d.template.Spec.Volumes) == 0 {
+			d.patchList = append(d.patchList, PatchOperation{
+				Op:    "add",
+				Path:  d.templateSpecPath + "/volumes",
+				Value: []struct{}{},
+			})
+		}
+		d.podVolumesEnsured = true
+	}
+}
+
+func (d *DeploymentPatch) ensurePodVolumeMountsExist() {
+	if !d.podVolumeMountsEnsured {
+		for index := range d.template.Spec.Containers {
+			if len(d.template.Spec.Containers[index].VolumeMounts) == 0 {
+				d.patchList = append(d.patchList, PatchOperation{
+					Op:    "add",
+					Path:  d.templateSpecPath + "/containers/" + strconv.Itoa(index) + "/volumeMounts",
+					Value: []struct{}{},
+				})
+			}
+		}
+		d.podVolumeMountsEnsured = true
+	}
+}
+
 // AppendToLabels appends the given map of labels to the deployment
 func (d *DeploymentPatch) AppendToLabels(config map[string]string) {
 	d.ensureLabelsExist()
 	for key, value := range config {
-		if d.deployment.Labels[key] == value {
+		if d.meta.Labels[key] == value {
 			// Already set; nothing to do here.
 			continue
 		}
@@ -142,7 +225,7 @@ func (d *DeploymentPatch) AppendToLabels(config map[string]string) {
 func (d *DeploymentPatch) AppendToPodLabels(config map[string]string) {
 	d.ensurePodLabelsExist()
 	for key, value := range config {
-		if d.deployment.Spec.Template.Labels[key] == value {
+		if d.template.Labels[key] == value {
 			// Already set; nothing to do here.
 			continue
 		}
@@ -151,7 +234,7 @@ func (d *DeploymentPatch) AppendToPodLabels(config map[string]string) {
 		escapedKey = strings.Replace(escapedKey, "/", "~1", -1)
 		d.patchList = append(d.patchList, PatchOperation{
 			Op:    "add",
-			Path:  "/spec/template/metadata/labels/" + escapedKey,
+			Path:  d.templateMetaPath + "/labels/" + escapedKey,
 			Value: value,
 		})
 	}
@@ -161,6 +244,10 @@ func (d *DeploymentPatch) AppendToPodLabels(config map[string]string) {
 func (d *DeploymentPatch) AppendToAnnotations(config map[string]string) {
 	d.ensureAnnotationsExist()
 	for key, value := range config {
+		if existing, ok := d.meta.Annotations[key]; ok && existing == value {
+			// Already set; nothing to do here.
+			continue
+		}
 		// https://stackoverflow.com/questions/36147137/kubernetes-api-add-label-to-pod#comment98654379_36163917
 		escapedKey := strings.Replace(key, "~", "~0", -1)
 		escapedKey = strings.Replace(escapedKey, "/", "~1", -1)
@@ -172,16 +259,37 @@ func (d *DeploymentPatch) AppendToAnnotations(config map[string]string) {
 	}
 }
 
+// RemoveFromAnnotations removes the given annotations from the deployment
+func (d *DeploymentPatch) RemoveFromAnnotations(keys []string) {
+	for _, key := range keys {
+		if _, ok := d.meta.Annotations[key]; !ok {
+			// Not set; nothing to do here.
+			continue
+		}
+		// https://stackoverflow.com/questions/36147137/kubernetes-api-add-label-to-pod#comment98654379_36163917
+		escapedKey := strings.Replace(key, "~", "~0", -1)
+		escapedKey = strings.Replace(escapedKey, "/", "~1", -1)
+		d.patchList = append(d.patchList, PatchOperation{
+			Op:   "remove",
+			Path: "/metadata/annotations/" + escapedKey,
+		})
+	}
+}
+
 // AppendToPodAnnotations adds given map of annotations to the pod template
 func (d *DeploymentPatch) AppendToPodAnnotations(config map[string]string) {
 	d.ensurePodAnnotationsExist()
 	for key, value := range config {
+		if existing, ok := d.template.Annotations[key]; ok && existing == value {
+			// Already set; nothing to do here.
+			continue
+		}
 		// https://stackoverflow.com/questions/36147137/kubernetes-api-add-label-to-pod#comment98654379_36163917
 		escapedKey := strings.Replace(key, "~", "~0", -1)
 		escapedKey = strings.Replace(escapedKey, "/", "~1", -1)
 		d.patchList = append(d.patchList, PatchOperation{
 			Op:    "add",
-			Path:  "/spec/template/metadata/annotations/" + escapedKey,
+			Path:  d.templateMetaPath + "/annotations/" + escapedKey,
 			Value: value,
 		})
 	}
@@ -202,18 +310,19 @@ func getKeyIdx(key string, env []corev1.EnvVar) int {
 func (d *DeploymentPatch) AppendToPodEnvironment(config map[string]string) {
 	d.ensurePodEnvironmentExists()
 
-	for index := range d.deployment.Spec.Template.Spec.Containers {
+	for index := range d.template.Spec.Containers {
 		for key, value := range config {
 			// Key exists in environment; modifying it.
-			existingIdx := getKeyIdx(key, d.deployment.Spec.Template.Spec.Containers[index].Env)
+			existingIdx := getKeyIdx(key, d.template.Spec.Containers[index].Env)
 			if existingIdx >= 0 {
-				if d.deployment.Spec.Template.Spec.Containers[index].Env[existingIdx].Value == value {
+				if d.template.Spec.Containers[index].Env[existingIdx].Value == value {
 					// Already set, skipping.
 					continue
 				}
+				d.testEnvName(fmt.Sprintf("%v/containers/%v/env/%v", d.templateSpecPath, strconv.Itoa(index), strconv.Itoa(existingIdx)), key)
 				d.patchList = append(d.patchList, PatchOperation{
 					Op:   "replace",
-					Path: fmt.Sprintf("/spec/template/spec/containers/%v/env/%v", strconv.Itoa(index), strconv.Itoa(existingIdx)),
+					Path: fmt.Sprintf("%v/containers/%v/env/%v", d.templateSpecPath, strconv.Itoa(index), strconv.Itoa(existingIdx)),
 					Value: map[string]string{
 						"name":  key,
 						"value": value,
@@ -223,7 +332,7 @@ func (d *DeploymentPatch) AppendToPodEnvironment(config map[string]string) {
 				// Key doesn't exist in environment; adding it.
 				d.patchList = append(d.patchList, PatchOperation{
 					Op:   "add",
-					Path: "/spec/template/spec/containers/" + strconv.Itoa(index) + "/env/-",
+					Path: d.templateSpecPath + "/containers/" + strconv.Itoa(index) + "/env/-",
 					Value: map[string]string{
 						"name":  key,
 						"value": value,
@@ -232,17 +341,18 @@ func (d *DeploymentPatch) AppendToPodEnvironment(config map[string]string) {
 			}
 		}
 	}
-	for index := range d.deployment.Spec.Template.Spec.InitContainers {
+	for index := range d.template.Spec.InitContainers {
 		for key, value := range config {
-			existingIdx := getKeyIdx(key, d.deployment.Spec.Template.Spec.InitContainers[index].Env)
+			existingIdx := getKeyIdx(key, d.template.Spec.InitContainers[index].Env)
 			if existingIdx >= 0 {
-				if d.deployment.Spec.Template.Spec.InitContainers[index].Env[existingIdx].Value == value {
+				if d.template.Spec.InitContainers[index].Env[existingIdx].Value == value {
 					// Already set, skipping.
 					continue
 				}
+				d.testEnvName(fmt.Sprintf("%v/initContainers/%v/env/%v", d.templateSpecPath, strconv.Itoa(index+d.prependedInitContainers), strconv.Itoa(existingIdx)), key)
 				d.patchList = append(d.patchList, PatchOperation{
 					Op:   "replace",
-					Path: fmt.Sprintf("/spec/template/spec/initContainers/%v/env/%v", strconv.Itoa(index), strconv.Itoa(existingIdx)),
+					Path: fmt.Sprintf("%v/initContainers/%v/env/%v", d.templateSpecPath, strconv.Itoa(index+d.prependedInitContainers), strconv.Itoa(existingIdx)),
 					Value: map[string]string{
 						"name":  key,
 						"value": value,
@@ -251,7 +361,7 @@ func (d *DeploymentPatch) AppendToPodEnvironment(config map[string]string) {
 			} else {
 				d.patchList = append(d.patchList, PatchOperation{
 					Op:   "add",
-					Path: "/spec/template/spec/initContainers/" + strconv.Itoa(index) + "/env/-",
+					Path: d.templateSpecPath + "/initContainers/" + strconv.Itoa(index+d.prependedInitContainers) + "/env/-",
 					Value: map[string]string{
 						"name":  key,
 						"value": value,
@@ -262,15 +372,265 @@ func (d *DeploymentPatch) AppendToPodEnvironment(config map[string]string) {
 	}
 }
 
+// RemoveFromPodEnvironment removes the given environment variables from all
+// containers and initContainers that are in the original podspec. The removals
+// refer to the indexes of the original podspec, so call this after all other
+// changes to the environment. Each removal is guarded by a test of the
+// variable name, so the patch fails instead of removing the wrong variable
+// when the original podspec is stale.
+func (d *DeploymentPatch) RemoveFromPodEnvironment(keys []string) {
+	for index, container := range d.template.Spec.Containers {
+		// Remove from the back so the indexes of the remaining variables stay valid.
+		for envIdx := len(container.Env) - 1; envIdx >= 0; envIdx-- {
+			if containsKey(keys, container.Env[envIdx].Name) {
+				path := fmt.Sprintf("%v/containers/%v/env/%v", d.templateSpecPath, strconv.Itoa(index), strconv.Itoa(envIdx))
+				d.testEnvName(path, container.Env[envIdx].Name)
+				d.patchList = append(d.patchList, PatchOperation{
+					Op:   "remove",
+					Path: path,
+				})
+			}
+		}
+	}
+	for index, container := range d.template.Spec.InitContainers {
+		for envIdx := len(container.Env) - 1; envIdx >= 0; envIdx-- {
+			if containsKey(keys, container.Env[envIdx].Name) {
+				path := fmt.Sprintf("%v/initContainers/%v/env/%v", d.templateSpecPath, strconv.Itoa(index+d.prependedInitContainers), strconv.Itoa(envIdx))
+				d.testEnvName(path, container.Env[envIdx].Name)
+				d.patchList = append(d.patchList, PatchOperation{
+					Op:   "remove",
+					Path: path,
+				})
+			}
+		}
+	}
+}
+
+// testEnvName adds a test operation that checks that the environment variable
+// at the given path still has the given name, so operations that address the
+// variable by index fail on a stale podspec
+func (d *DeploymentPatch) testEnvName(envPath string, name string) {
+	d.patchList = append(d.patchList, PatchOperation{
+		Op:    "test",
+		Path:  envPath + "/name",
+		Value: name,
+	})
+}
+
+// containsKey returns true when the key is in the list of keys.
+func containsKey(keys []string, key string) bool {
+	for _, value := range keys {
+		if value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendToPodVolumes adds the given volume to the pod template unless a volume
+// with the same name already exists
+func (d *DeploymentPatch) AppendToPodVolumes(volume corev1.Volume) {
+	for _, existing := range d.template.Spec.Volumes {
+		if existing.Name == volume.Name {
+			// Already present; nothing to do here.
+			return
+		}
+	}
+	d.ensurePodVolumesExist()
+	d.patchList = append(d.patchList, PatchOperation{
+		Op:    "add",
+		Path:  d.templateSpecPath + "/volumes/-",
+		Value: volume,
+	})
+}
+
+// AppendToPodVolumeMounts adds the given volume mount to all containers in the
+// original podspec that don't mount a volume with the same name yet
+func (d *DeploymentPatch) AppendToPodVolumeMounts(mount corev1.VolumeMount) {
+	d.ensurePodVolumeMountsExist()
+
+	for index, container := range d.template.Spec.Containers {
+		mounted := false
+		for _, existing := range container.VolumeMounts {
+			if existing.Name == mount.Name {
+				mounted = true
+				break
+			}
+		}
+		if mounted {
+			continue
+		}
+		d.patchList = append(d.patchList, PatchOperation{
+			Op:    "add",
+			Path:  d.templateSpecPath + "/containers/" + strconv.Itoa(index) + "/volumeMounts/-",
+			Value: mount,
+		})
+	}
+}
+
+// RemoveFromPodVolumes removes the volumes with the given names from the
+// template, and their mounts from all containers in the original podspec. The
+// removals refer to the indexes of the original podspec, so call this before
+// containers are replaced. Each removal is guarded by a test of the name, so
+// the patch fails instead of removing the wrong volume when the original
+// podspec is stale.
+func (d *DeploymentPatch) RemoveFromPodVolumes(names []string) {
+	for index, container := range d.template.Spec.Containers {
+		// Remove from the back so the indexes of the remaining mounts stay valid.
+		for mountIdx := len(container.VolumeMounts) - 1; mountIdx >= 0; mountIdx-- {
+			if containsKey(names, container.VolumeMounts[mountIdx].Name) {
+				d.removeNamed(fmt.Sprintf("%v/containers/%v/volumeMounts/%v", d.templateSpecPath, strconv.Itoa(index), strconv.Itoa(mountIdx)), container.VolumeMounts[mountIdx].Name)
+			}
+		}
+	}
+	volumes := d.template.Spec.Volumes
+	for volumeIdx := len(volumes) - 1; volumeIdx >= 0; volumeIdx-- {
+		if containsKey(names, volumes[volumeIdx].Name) {
+			d.removeNamed(fmt.Sprintf("%v/volumes/%v", d.templateSpecPath, strconv.Itoa(volumeIdx)), volumes[volumeIdx].Name)
+		}
+	}
+}
+
+// RemoveFromPodContainers removes the containers with the given names from the
+// template. The removals shift the indexes of the containers, so call this
+// after all other changes to the containers.
+func (d *DeploymentPatch) RemoveFromPodContainers(names []string) {
+	containers := d.template.Spec.Containers
+	for index := len(containers) - 1; index >= 0; index-- {
+		if containsKey(names, containers[index].Name) {
+			d.removeNamed(fmt.Sprintf("%v/containers/%v", d.templateSpecPath, strconv.Itoa(index)), containers[index].Name)
+		}
+	}
+}
+
+// removeNamed removes the element at the given path, guarded by a test of its
+// name.
+func (d *DeploymentPatch) removeNamed(path string, name string) {
+	d.patchList = append(d.patchList,
+		PatchOperation{
+			Op:    "test",
+			Path:  path + "/name",
+			Value: name,
+		},
+		PatchOperation{
+			Op:   "remove",
+			Path: path,
+		},
+	)
+}
+
 // PrependToPodInitContainers prepends an init container to the template
 func (d *DeploymentPatch) PrependToPodInitContainers(container corev1.Container) {
 	d.ensurePodInitContainersExists()
 
 	d.patchList = append(d.patchList, PatchOperation{
 		Op:    "add",
-		Path:  "/spec/template/spec/initContainers/0",
+		Path:  d.templateSpecPath + "/initContainers/0",
 		Value: container,
 	})
+	d.prependedInitContainers++
+}
+
+// SetPodInitContainer makes sure the template has the given init container. An
+// init container with the same name is replaced in place when it differs;
+// otherwise the init container is prepended to the template.
+func (d *DeploymentPatch) SetPodInitContainer(container corev1.Container) {
+	for index, existing := range d.template.Spec.InitContainers {
+		if existing.Name != container.Name {
+			continue
+		}
+		d.replaceContainer(fmt.Sprintf("%v/initContainers/%v", d.templateSpecPath, strconv.Itoa(index+d.prependedInitContainers)), existing, container)
+		return
+	}
+	d.PrependToPodInitContainers(container)
+}
+
+// SetPodContainer makes sure the template has the given container. A container
+// with the same name is replaced in place when it differs; otherwise the
+// container is appended to the template. Call this after the changes to the
+// volume mounts of the containers, so the replacement has the final say.
+func (d *DeploymentPatch) SetPodContainer(container corev1.Container) {
+	for index, existing := range d.template.Spec.Containers {
+		if existing.Name != container.Name {
+			continue
+		}
+		d.replaceContainer(fmt.Sprintf("%v/containers/%v", d.templateSpecPath, strconv.Itoa(index)), existing, container)
+		return
+	}
+	d.AppendToPodContainers(container)
+}
+
+// replaceContainer replaces the existing container at the given path with the
+// desired one, unless the existing container already has everything the
+// desired one sets. The replacement is guarded by a test of the name, so it
+// fails on a stale podspec.
+func (d *DeploymentPatch) replaceContainer(path string, existing, desired corev1.Container) {
+	if containerHas(existing, desired) {
+		// Already set; nothing to do here.
+		return
+	}
+	d.patchList = append(d.patchList,
+		PatchOperation{
+			Op:    "test",
+			Path:  path + "/name",
+			Value: existing.Name,
+		},
+		PatchOperation{
+			Op:    "replace",
+			Path:  path,
+			Value: desired,
+		},
+	)
+}
+
+// containerHas returns true when every field that is set in the desired
+// container has the same value in the existing one. Fields the API server
+// defaults, like the termination message path, are only set in the existing
+// container, so they don't count as a difference.
+func containerHas(existing, desired corev1.Container) bool {
+	var existingFields, desiredFields map[string]interface{}
+	for _, c := range []struct {
+		container corev1.Container
+		fields    *map[string]interface{}
+	}{{existing, &existingFields}, {desired, &desiredFields}} {
+		data, err := json.Marshal(c.container)
+		if err != nil {
+			return false
+		}
+		if err := json.Unmarshal(data, c.fields); err != nil {
+			return false
+		}
+	}
+	for key, value := range desiredFields {
+		if !reflect.DeepEqual(existingFields[key], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendToPodContainers appends a container to the template
+func (d *DeploymentPatch) AppendToPodContainers(container corev1.Container) {
+	d.patchList = append(d.patchList, PatchOperation{
+		Op:    "add",
+		Path:  d.templateSpecPath + "/containers/-",
+		Value: container,
+	})
+}
+
+// EnablePodShareProcessNamespace lets the containers of the template see each
+// other's processes
+func (d *DeploymentPatch) EnablePodShareProcessNamespace() {
+	share := d.template.Spec.ShareProcessNamespace
+	if share != nil && *share {
+		// Already enabled; nothing to do here.
+		return
+	}
+	d.patchList = append(d.patchList, PatchOperation{
+		Op:    "add",
+		Path:  d.templateSpecPath + "/shareProcessNamespace",
+		Value: true,
+	})
 }
 
 // GetPatch returns the resulting array of PatchOperation objects
@@ -0,0 +1,160 @@
+package deploymentpatch
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func deploymentWithInitContainers(containers ...corev1.Container) appsv1.Deployment {
+	var deployment appsv1.Deployment
+	deployment.Spec.Template.Spec.InitContainers = containers
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "app"}}
+	return deployment
+}
+
+func TestSetPodInitContainer(t *testing.T) {
+	init := corev1.Container{
+		Name:  "init",
+		Image: "init:v2",
+		Env:   []corev1.EnvVar{{Name: "TENGU_REQUIRED_VARS", Value: "DB"}},
+	}
+	// the init container as the API server returns it
+	defaulted := *init.DeepCopy()
+	defaulted.ImagePullPolicy = corev1.PullIfNotPresent
+	defaulted.TerminationMessagePath = corev1.TerminationMessagePathDefault
+	outdated := *defaulted.DeepCopy()
+	outdated.Image = "init:v1"
+	setup := corev1.Container{Name: "setup", Image: "setup"}
+	extra := corev1.Container{Name: "extra", Image: "extra"}
+
+	tests := []struct {
+		name     string
+		existing []corev1.Container
+		set      []corev1.Container
+		want     []PatchOperation
+	}{
+		{
+			name: "prepend to a template without init containers",
+			set:  []corev1.Container{init},
+			want: []PatchOperation{
+				{Op: "add", Path: "/spec/template/spec/initContainers", Value: []struct{}{}},
+				{Op: "add", Path: "/spec/template/spec/initContainers/0", Value: init},
+			},
+		},
+		{
+			name:     "prepend to other init containers",
+			existing: []corev1.Container{setup},
+			set:      []corev1.Container{init},
+			want: []PatchOperation{
+				{Op: "add", Path: "/spec/template/spec/initContainers/0", Value: init},
+			},
+		},
+		{
+			name:     "server defaults aren't a difference",
+			existing: []corev1.Container{setup, defaulted},
+			set:      []corev1.Container{init},
+		},
+		{
+			name:     "replace in place",
+			existing: []corev1.Container{setup, outdated},
+			set:      []corev1.Container{init},
+			want: []PatchOperation{
+				{Op: "test", Path: "/spec/template/spec/initContainers/1/name", Value: "init"},
+				{Op: "replace", Path: "/spec/template/spec/initContainers/1", Value: init},
+			},
+		},
+		{
+			name:     "replace after a prepend",
+			existing: []corev1.Container{setup, outdated},
+			set:      []corev1.Container{extra, init},
+			want: []PatchOperation{
+				{Op: "add", Path: "/spec/template/spec/initContainers/0", Value: extra},
+				{Op: "test", Path: "/spec/template/spec/initContainers/2/name", Value: "init"},
+				{Op: "replace", Path: "/spec/template/spec/initContainers/2", Value: init},
+			},
+		},
+		{
+			name: "variables in the same order aren't a difference",
+			existing: []corev1.Container{func() corev1.Container {
+				c := *defaulted.DeepCopy()
+				c.Env = append(c.Env, corev1.EnvVar{Name: "DB", Value: "db.example"})
+				return c
+			}()},
+			set: []corev1.Container{func() corev1.Container {
+				c := *init.DeepCopy()
+				c.Env = append(c.Env, corev1.EnvVar{Name: "DB", Value: "db.example"})
+				return c
+			}()},
+		},
+		{
+			name: "variables the desired container lacks are a difference",
+			existing: []corev1.Container{func() corev1.Container {
+				c := *defaulted.DeepCopy()
+				c.Env = append(c.Env, corev1.EnvVar{Name: "DB", Value: "db.example"})
+				return c
+			}()},
+			set: []corev1.Container{init},
+			want: []PatchOperation{
+				{Op: "test", Path: "/spec/template/spec/initContainers/0/name", Value: "init"},
+				{Op: "replace", Path: "/spec/template/spec/initContainers/0", Value: init},
+			},
+		},
+	}
+	for _, test := range tests {
+		patch := New(deploymentWithInitContainers(test.existing...))
+		for _, container := range test.set {
+			patch.SetPodInitContainer(container)
+		}
+		if got := patch.GetPatch(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got patch %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetPodInitContainerForPod(t *testing.T) {
+	init := corev1.Container{Name: "init", Image: "init:v2"}
+	var pod corev1.Pod
+	pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "init:v1"}}
+	patch := NewForPod(pod)
+	patch.SetPodInitContainer(init)
+	want := []PatchOperation{
+		{Op: "test", Path: "/spec/initContainers/0/name", Value: "init"},
+		{Op: "replace", Path: "/spec/initContainers/0", Value: init},
+	}
+	if got := patch.GetPatch(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got patch %+v, want %+v", got, want)
+	}
+}
+
+func TestRemoveFromPod(t *testing.T) {
+	var deployment appsv1.Deployment
+	deployment.Spec.Template.Spec.Volumes = []corev1.Volume{{Name: "data"}, {Name: "status"}, {Name: "live"}}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{
+		{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "status"}, {Name: "data"}, {Name: "live"}}},
+		{Name: "sidecar", VolumeMounts: []corev1.VolumeMount{{Name: "live"}}},
+		{Name: "other"},
+	}
+	patch := New(deployment)
+	patch.RemoveFromPodVolumes([]string{"status", "live"})
+	patch.RemoveFromPodContainers([]string{"sidecar", "missing"})
+	want := []PatchOperation{
+		{Op: "test", Path: "/spec/template/spec/containers/0/volumeMounts/2/name", Value: "live"},
+		{Op: "remove", Path: "/spec/template/spec/containers/0/volumeMounts/2"},
+		{Op: "test", Path: "/spec/template/spec/containers/0/volumeMounts/0/name", Value: "status"},
+		{Op: "remove", Path: "/spec/template/spec/containers/0/volumeMounts/0"},
+		{Op: "test", Path: "/spec/template/spec/containers/1/volumeMounts/0/name", Value: "live"},
+		{Op: "remove", Path: "/spec/template/spec/containers/1/volumeMounts/0"},
+		{Op: "test", Path: "/spec/template/spec/volumes/2/name", Value: "live"},
+		{Op: "remove", Path: "/spec/template/spec/volumes/2"},
+		{Op: "test", Path: "/spec/template/spec/volumes/1/name", Value: "status"},
+		{Op: "remove", Path: "/spec/template/spec/volumes/1"},
+		{Op: "test", Path: "/spec/template/spec/containers/1/name", Value: "sidecar"},
+		{Op: "remove", Path: "/spec/template/spec/containers/1"},
+	}
+	if got := patch.GetPatch(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got patch %+v, want %+v", got, want)
+	}
+}
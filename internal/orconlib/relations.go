@@ -0,0 +1,44 @@
+package orconlib
+
+import "fmt"
+
+const (
+	// RelationsVolumeName is the name of the volume holding the relations
+	// ConfigMap of a consumer.
+	RelationsVolumeName = "tengu-relations"
+	// RelationsMountPath is where the relations ConfigMap is mounted; every
+	// relation variable is a file in this directory.
+	RelationsMountPath = "/etc/tengu/relations"
+
+	// StatusVolumeName is the name of the emptyDir volume the init container
+	// writes its status file to.
+	StatusVolumeName = "tengu-status"
+	// StatusMountPath is where the status volume is mounted in the init
+	// container and in the containers of the consumer.
+	StatusMountPath = "/etc/tengu/status"
+	// StatusFileName is the name of the status file in the status volume.
+	StatusFileName = "relations.json"
+
+	// SidecarVolumeName is the name of the emptyDir volume the sidecar keeps
+	// the relations of the consumer up to date in.
+	SidecarVolumeName = "tengu-live"
+	// SidecarMountPath is where the sidecar volume is mounted in the sidecar
+	// and in the containers of the consumer.
+	SidecarMountPath = "/etc/tengu/live"
+)
+
+// RelationsConfigMapName returns the name of the ConfigMap holding the relation
+// data of the deployment with the given name.
+func RelationsConfigMapName(deploymentName string) string {
+	return fmt.Sprintf("%s-tengu-relations", deploymentName)
+}
+
+// LiveRelations returns true when the init container of a consumer reads its
+// relations from the relations ConfigMap instead of from its environment, as
+// set by the `tengu.io/init-mode` annotation, or when the consumer has a
+// sidecar that watches the relations ConfigMap, as set by the
+// `tengu.io/sidecar` annotation.
+func LiveRelations(annotations map[string]string) bool {
+	mode := annotations["tengu.io/init-mode"]
+	return mode == "volume" || mode == "api" || annotations["tengu.io/sidecar"] != ""
+}
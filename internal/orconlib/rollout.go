@@ -0,0 +1,57 @@
+package orconlib
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// RolloutPolicy decides how changed relation data reaches a consumer.
+type RolloutPolicy string
+
+const (
+	// PolicyImmediate patches the pod environment right away, restarting the
+	// consumer. This is the default.
+	PolicyImmediate RolloutPolicy = "immediate"
+	// PolicyDebounce collects changes during the debounce window and patches
+	// them in a single rollout afterwards.
+	PolicyDebounce RolloutPolicy = "debounce"
+	// PolicyConfigMap only updates a ConfigMap that is mounted in the consumer,
+	// so the consumer is never restarted for relation changes.
+	PolicyConfigMap RolloutPolicy = "configmap"
+	// PolicyManual holds changes back until the user approves them.
+	PolicyManual RolloutPolicy = "manual"
+)
+
+// RolloutPolicies parses the `tengu.io/rollout-policy` annotation of a
+// consumer. The annotation is a comma-separated list of `relation=policy`
+// pairs; an entry without a relation name sets the policy for all relations
+// that aren't listed explicitly.
+func RolloutPolicies(deployment *appsv1.Deployment) (RolloutPolicy, map[string]RolloutPolicy) {
+	defaultPolicy := PolicyImmediate
+	policies := make(map[string]RolloutPolicy)
+	annotation := deployment.Annotations["tengu.io/rollout-policy"]
+	if annotation == "" {
+		return defaultPolicy, policies
+	}
+	for _, entry := range strings.Split(annotation, ",") {
+		relation, policy := "", strings.TrimSpace(entry)
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			relation, policy = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+		switch RolloutPolicy(policy) {
+		case PolicyImmediate, PolicyDebounce, PolicyConfigMap, PolicyManual:
+		default:
+			log.Warnf("Unknown rollout policy %q on deployment %s, using %q", policy, deployment.Name, PolicyImmediate)
+			policy = string(PolicyImmediate)
+		}
+		if relation == "" {
+			defaultPolicy = RolloutPolicy(policy)
+		} else {
+			policies[relation] = RolloutPolicy(policy)
+		}
+	}
+	return defaultPolicy, policies
+}
@@ -0,0 +1,71 @@
+package reload
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Kinds of reload.
+const (
+	// Files only writes the relations to the shared volume; the application
+	// watches the files itself.
+	Files = "files"
+	// SIGHUP sends SIGHUP to a process of the application. The pod needs to
+	// share its process namespace.
+	SIGHUP = "sighup"
+	// HTTP posts to a reload endpoint of the application.
+	HTTP = "http"
+)
+
+// Reload tells the sidecar how to notify the application of changed
+// relations.
+type Reload struct {
+	// Kind is one of the kinds of reload.
+	Kind string
+	// Process is the name of the process to signal.
+	Process string
+	// URL is the reload endpoint of the application.
+	URL string
+}
+
+// Parse parses the reload configuration, as set in the `tengu.io/sidecar`
+// annotation of a consumer. The format is `files`, `sighup:<process>` or the
+// http(s) URL of the reload endpoint, for example
+// `http://localhost:8080/-/reload`.
+func Parse(config string) (Reload, error) {
+	config = strings.TrimSpace(config)
+	switch {
+	case config == Files:
+		return Reload{Kind: Files}, nil
+	case strings.HasPrefix(config, SIGHUP+":"):
+		process := strings.TrimSpace(strings.TrimPrefix(config, SIGHUP+":"))
+		if process == "" || strings.Contains(process, "/") {
+			return Reload{}, fmt.Errorf("invalid process name %q", process)
+		}
+		return Reload{Kind: SIGHUP, Process: process}, nil
+	case strings.HasPrefix(config, "http://"), strings.HasPrefix(config, "https://"):
+		u, err := url.Parse(config)
+		if err != nil {
+			return Reload{}, err
+		}
+		if u.Host == "" {
+			return Reload{}, fmt.Errorf("reload URL %q has no host", config)
+		}
+		return Reload{Kind: HTTP, URL: config}, nil
+	default:
+		return Reload{}, fmt.Errorf("unknown reload %q, expected %q, %q or an http(s) URL", config, Files, SIGHUP+":<process>")
+	}
+}
+
+// String returns the reload in the format accepted by Parse.
+func (r Reload) String() string {
+	switch r.Kind {
+	case SIGHUP:
+		return SIGHUP + ":" + r.Process
+	case HTTP:
+		return r.URL
+	default:
+		return r.Kind
+	}
+}
@@ -0,0 +1,85 @@
+package requirement
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of checks.
+const (
+	// CheckEnv only checks that the variable is set. This is the default.
+	CheckEnv = "env"
+	// CheckDNS checks that the host resolves.
+	CheckDNS = "dns"
+	// CheckTCP checks that a TCP connection to the port succeeds.
+	CheckTCP = "tcp"
+	// CheckHTTP and CheckHTTPS check that a GET of the path succeeds.
+	CheckHTTP  = "http"
+	CheckHTTPS = "https"
+)
+
+// Check verifies that the provider behind a relation is reachable.
+type Check struct {
+	// Kind is one of the Check* constants.
+	Kind string
+	// Port is the port to dial or to poll; empty means the default port
+	// of the check.
+	Port string
+	// Path is the path to poll for http(s) checks.
+	Path string
+}
+
+// ParseCheck parses a check configuration. The format is `kind[:port][/path]`,
+// for example `dns`, `tcp:5432` or `http:8080/healthz`. An empty
+// configuration only checks that the variable is set.
+func ParseCheck(config string) (Check, error) {
+	config = strings.TrimSpace(config)
+	if config == "" {
+		return Check{Kind: CheckEnv}, nil
+	}
+	var c Check
+	if slash := strings.Index(config, "/"); slash >= 0 {
+		c.Path = config[slash:]
+		config = config[:slash]
+	}
+	parts := strings.SplitN(config, ":", 2)
+	c.Kind = strings.ToLower(parts[0])
+	if len(parts) == 2 {
+		c.Port = parts[1]
+	}
+	switch c.Kind {
+	case CheckEnv, CheckDNS:
+		if c.Port != "" || c.Path != "" {
+			return c, fmt.Errorf("check %q doesn't take a port or path", c.Kind)
+		}
+	case CheckTCP:
+		if c.Port == "" {
+			return c, fmt.Errorf("check %q needs a port", c.Kind)
+		}
+		if c.Path != "" {
+			return c, fmt.Errorf("check %q doesn't take a path", c.Kind)
+		}
+	case CheckHTTP, CheckHTTPS:
+		if c.Path == "" {
+			c.Path = "/"
+		}
+	default:
+		return c, fmt.Errorf("unknown check %q", c.Kind)
+	}
+	if c.Port != "" {
+		if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+			return c, fmt.Errorf("invalid port %q: must be a number from 1 to 65535", c.Port)
+		}
+	}
+	return c, nil
+}
+
+// String returns the check in the format accepted by ParseCheck.
+func (c Check) String() string {
+	result := c.Kind
+	if c.Port != "" {
+		result += ":" + c.Port
+	}
+	return result + c.Path
+}
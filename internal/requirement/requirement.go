@@ -0,0 +1,128 @@
+package requirement
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namePattern matches the interface names that can be turned into environment
+// variable names.
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Requirement is a relation a consumer declares in its `tengu.io/consumes`
+// annotation. Each entry of the annotation has the format
+// `name[?][:check][=default]`, for example `db:tcp:5432`, `cache?` or
+// `sse:http:8080/healthz=localhost`. The first `=` starts the default, so a
+// check can't contain `=` and an http(s) check can't have a query string.
+type Requirement struct {
+	// Name is the interface of the provider, as in its `tengu.io/provides`
+	// label.
+	Name string
+	// Optional requirements don't block the consumer.
+	Optional bool
+	// Check verifies that the provider is reachable.
+	Check Check
+	// Default is used when no provider is available and HasDefault is set.
+	Default    string
+	HasDefault bool
+}
+
+// Blocking returns true when the consumer can't start without a provider for
+// the requirement. Optional requirements and requirements with a default
+// value don't block the consumer.
+func (r Requirement) Blocking() bool {
+	return !r.Optional && !r.HasDefault
+}
+
+// Var returns the name of the environment variable that holds the relation.
+func (r Requirement) Var() string {
+	return strings.ToUpper(r.Name)
+}
+
+// String returns the requirement in the format accepted by Parse.
+func (r Requirement) String() string {
+	result := r.Name
+	if r.Optional {
+		result += "?"
+	}
+	if r.Check.Kind != CheckEnv {
+		result += ":" + r.Check.String()
+	}
+	if r.HasDefault {
+		result += "=" + r.Default
+	}
+	return result
+}
+
+// Parse parses a comma-separated list of requirements. Whitespace around
+// entries is ignored, as are empty entries. Names are case-insensitive and
+// must be unique.
+func Parse(list string) ([]Requirement, error) {
+	requirements := []Requirement{}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		r, err := parseEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.Var()] {
+			return nil, fmt.Errorf("relation %q is declared more than once", r.Name)
+		}
+		seen[r.Var()] = true
+		requirements = append(requirements, r)
+	}
+	return requirements, nil
+}
+
+// parseEntry parses a single requirement.
+func parseEntry(entry string) (Requirement, error) {
+	var r Requirement
+	if equals := strings.Index(entry, "="); equals >= 0 {
+		r.Default, r.HasDefault = strings.TrimSpace(entry[equals+1:]), true
+		entry = entry[:equals]
+	}
+	name, check := entry, ""
+	if colon := strings.Index(entry, ":"); colon >= 0 {
+		name, check = entry[:colon], entry[colon+1:]
+	}
+	if strings.Contains(check, "?") {
+		return r, fmt.Errorf("invalid check for relation %q: a check can't have a query string", strings.TrimSpace(name))
+	}
+	name = strings.TrimSpace(name)
+	if strings.HasSuffix(name, "?") {
+		r.Optional = true
+		name = strings.TrimSpace(strings.TrimSuffix(name, "?"))
+	}
+	if err := ValidateName(name); err != nil {
+		return r, err
+	}
+	r.Name = name
+	var err error
+	if r.Check, err = ParseCheck(check); err != nil {
+		return r, fmt.Errorf("invalid check for relation %q: %v", name, err)
+	}
+	return r, nil
+}
+
+// ValidateName checks that an interface name can be turned into an environment
+// variable name. Consumers and providers use the same names.
+func ValidateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid relation name %q: must consist of letters, digits and '_' and not start with a digit", name)
+	}
+	return nil
+}
+
+// Vars returns the environment variable names of the given requirements.
+func Vars(requirements []Requirement) []string {
+	vars := make([]string, 0, len(requirements))
+	for _, r := range requirements {
+		vars = append(vars, r.Var())
+	}
+	return vars
+}
@@ -0,0 +1,120 @@
+package requirement
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []Requirement
+		wantErr bool
+	}{
+		{list: "", want: []Requirement{}},
+		{list: " , ", want: []Requirement{}},
+		{list: "db", want: []Requirement{{Name: "db", Check: Check{Kind: CheckEnv}}}},
+		{list: " db , sse ", want: []Requirement{
+			{Name: "db", Check: Check{Kind: CheckEnv}},
+			{Name: "sse", Check: Check{Kind: CheckEnv}},
+		}},
+		{list: "db:tcp:5432", want: []Requirement{{Name: "db", Check: Check{Kind: CheckTCP, Port: "5432"}}}},
+		{list: "cache?", want: []Requirement{{Name: "cache", Optional: true, Check: Check{Kind: CheckEnv}}}},
+		{list: "sse?:http:8080/healthz=localhost", want: []Requirement{{
+			Name:       "sse",
+			Optional:   true,
+			Check:      Check{Kind: CheckHTTP, Port: "8080", Path: "/healthz"},
+			Default:    "localhost",
+			HasDefault: true,
+		}}},
+		{list: "db=db.example:5432", want: []Requirement{{
+			Name:       "db",
+			Check:      Check{Kind: CheckEnv},
+			Default:    "db.example:5432",
+			HasDefault: true,
+		}}},
+		{list: "web:https", want: []Requirement{{Name: "web", Check: Check{Kind: CheckHTTPS, Path: "/"}}}},
+		// duplicates, also when they only differ in case
+		{list: "db,db", wantErr: true},
+		{list: "db,DB", wantErr: true},
+		// bad names
+		{list: "1db", wantErr: true},
+		{list: "my-db", wantErr: true},
+		{list: ":tcp:5432", wantErr: true},
+		// bad checks
+		{list: "db:ping", wantErr: true},
+		{list: "db:tcp", wantErr: true},
+		{list: "db:tcp:postgres", wantErr: true},
+		{list: "db:tcp:99999", wantErr: true},
+		{list: "db:tcp:0", wantErr: true},
+		{list: "db:dns:53", wantErr: true},
+		{list: "db:tcp:5432/path", wantErr: true},
+		{list: "web:http:http/", wantErr: true},
+		{list: "web:http/health?a=b", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.list)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v, want an error", test.list, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) returned error %v", test.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.list, got, test.want)
+		}
+	}
+}
+
+func TestRequirementString(t *testing.T) {
+	for _, entry := range []string{"db", "cache?", "db:tcp:5432", "sse?:http:8080/healthz=localhost", "db=localhost"} {
+		requirements, err := Parse(entry)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", entry, err)
+		}
+		if got := requirements[0].String(); got != entry {
+			t.Errorf("Parse(%q).String() = %q", entry, got)
+		}
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	tests := map[string]bool{
+		"db":         true,
+		"db:tcp:543": true,
+		"db?":        false,
+		"db=local":   false,
+		"db?=local":  false,
+	}
+	for entry, want := range tests {
+		requirements, err := Parse(entry)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error %v", entry, err)
+		}
+		if got := requirements[0].Blocking(); got != want {
+			t.Errorf("Parse(%q).Blocking() = %v, want %v", entry, got, want)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := map[string]bool{
+		"db":       true,
+		"_db":      true,
+		"DB_2":     true,
+		"":         false,
+		"2db":      false,
+		"my-db":    false,
+		"db name":  false,
+		"db.local": false,
+	}
+	for name, valid := range tests {
+		if err := ValidateName(name); (err == nil) != valid {
+			t.Errorf("ValidateName(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}